@@ -0,0 +1,226 @@
+// 后端接口客户端：单元信息、用户在课程中的身份及课程详情。
+//
+// 请求带超时及context，网络错误和5xx响应按Retries重试(间隔RetryWait，逐次加倍)；
+// 接口返回errcode非0时为*APIError，请求失败为*RequestError，响应格式错误为*DecodeError。
+// 离线测试见backendtest。
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+)
+
+type Client struct {
+	// 接口域名，如 http://api.example.com
+	Domain string
+	// 公开的单元信息接口，含:unit_id，为空时使用Domain下的单元接口
+	UnitInfoApi string
+
+	HTTPClient *http.Client
+	Retries    int
+	RetryWait  time.Duration
+}
+
+func New(domain string) *Client {
+	return &Client{
+		Domain:     strings.TrimRight(domain, "/"),
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+		Retries:    2,
+		RetryWait:  200 * time.Millisecond,
+	}
+}
+
+func NewFromConfig(conf config.Api) *Client {
+	c := New(conf.Domain)
+	c.UnitInfoApi = conf.UnitInfo
+	return c
+}
+
+// 接口返回errcode非0
+type APIError struct {
+	Path    string
+	Errcode int
+	Errmsg  string
+}
+
+func (e *APIError) Error() string {
+	return e.Errmsg
+}
+
+// 请求失败：网络错误或非2xx响应。Path不含查询参数，避免token写入日志
+type RequestError struct {
+	Path       string
+	StatusCode int
+	Err        error
+}
+
+func (e *RequestError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("backend %s: %s", e.Path, e.Err)
+	}
+	return fmt.Sprintf("backend %s: status %d", e.Path, e.StatusCode)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// 是否可重试
+func (e *RequestError) Temporary() bool {
+	return e.Err != nil || e.StatusCode >= http.StatusInternalServerError
+}
+
+// 响应格式错误
+type DecodeError struct {
+	Path string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("backend %s: bad response: %s", e.Path, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// 查询单元信息
+func (c *Client) Unit(ctx context.Context, token, unitId string) (*Unit, error) {
+	unit := new(Unit)
+	path := "/v1/units/" + url.PathEscape(unitId) + "/get"
+	if err := c.get(ctx, c.Domain+path, url.Values{"token": {token}}, unit); err != nil {
+		return nil, err
+	}
+	return unit, nil
+}
+
+// 查询单元信息(公开接口，无需token)
+func (c *Client) PublicUnit(ctx context.Context, unitId string) (*Unit, error) {
+	if c.UnitInfoApi == "" {
+		return c.Unit(ctx, "", unitId)
+	}
+	unit := new(Unit)
+	api := strings.Replace(c.UnitInfoApi, ":unit_id", url.PathEscape(unitId), -1)
+	if err := c.get(ctx, api, nil, unit); err != nil {
+		return nil, err
+	}
+	return unit, nil
+}
+
+// 查询用户在单元所属课程中的身份
+func (c *Client) Identity(ctx context.Context, token, unitId, uid string) (*Identity, error) {
+	identity := new(Identity)
+	path := "/v1/units/" + url.PathEscape(unitId) + "/users/" + url.PathEscape(uid) + "/detail"
+	if err := c.get(ctx, c.Domain+path, url.Values{"token": {token}}, identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// 查询课程详情
+func (c *Client) Course(ctx context.Context, courseId string) (*Course, error) {
+	course := new(Course)
+	path := "/v1/courses/" + url.PathEscape(courseId) + "/detail"
+	if err := c.get(ctx, c.Domain+path, nil, course); err != nil {
+		return nil, err
+	}
+	return course, nil
+}
+
+// 单元所属课程是否公开且免费
+func (c *Client) IsPublicAndPremium(ctx context.Context, unitId string) (bool, error) {
+	unit, err := c.PublicUnit(ctx, unitId)
+	if err != nil {
+		return false, err
+	}
+	if unit.CourseId == "" {
+		return false, &DecodeError{Path: "unit " + unitId, Err: errors.New("missing course_id")}
+	}
+	course, err := c.Course(ctx, unit.CourseId)
+	if err != nil {
+		return false, err
+	}
+	return bool(course.Public && course.Premium), nil
+}
+
+// 发送GET请求，解析响应中的data到data，失败时按需重试
+func (c *Client) get(ctx context.Context, api string, query url.Values, data interface{}) error {
+	u, err := url.Parse(api)
+	if err != nil {
+		return err
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	for attempt := 0; ; attempt++ {
+		err = c.do(ctx, u, data)
+		re, ok := err.(*RequestError)
+		if !ok || !re.Temporary() || attempt >= c.Retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(c.RetryWait << uint(attempt)):
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, u *url.URL, data interface{}) error {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return &RequestError{Path: u.Path, Err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &RequestError{Path: u.Path, Err: err}
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return &RequestError{Path: u.Path, StatusCode: resp.StatusCode}
+	}
+
+	var response struct {
+		Errcode int             `json:"errcode"`
+		Errmsg  string          `json:"errmsg"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		if resp.StatusCode/100 != 2 {
+			return &RequestError{Path: u.Path, StatusCode: resp.StatusCode}
+		}
+		return &DecodeError{Path: u.Path, Err: err}
+	}
+	if response.Errcode != 0 {
+		return &APIError{Path: u.Path, Errcode: response.Errcode, Errmsg: response.Errmsg}
+	}
+	if resp.StatusCode/100 != 2 {
+		return &RequestError{Path: u.Path, StatusCode: resp.StatusCode}
+	}
+	if data == nil {
+		return nil
+	}
+	if len(response.Data) == 0 || string(response.Data) == "null" {
+		return &DecodeError{Path: u.Path, Err: errors.New("missing data")}
+	}
+	if err := json.Unmarshal(response.Data, data); err != nil {
+		return &DecodeError{Path: u.Path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package backend_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/darling-kefan/xj/backend"
+	"github.com/darling-kefan/xj/backend/backendtest"
+)
+
+func newTestServer() *backendtest.Server {
+	srv := backendtest.NewServer()
+	srv.Token = "systoken"
+	srv.AddUnit(&backend.Unit{UnitId: "u1", CourseId: "c1", Classroom: []backend.Classroom{{Id: "r1"}}})
+	srv.AddUnit(&backend.Unit{UnitId: "u2", CourseId: "c2"})
+	srv.AddUnit(&backend.Unit{UnitId: "u3"})
+	srv.AddIdentity("u1", &backend.Identity{Uid: "101", Identity: "1", CourseId: "c1"})
+	srv.AddCourse(&backend.Course{CourseId: "c1", Public: true, Premium: true})
+	srv.AddCourse(&backend.Course{CourseId: "c2", Public: true})
+	return srv
+}
+
+func TestUnit(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	ctx := context.Background()
+	client := srv.APIClient()
+
+	unit, err := client.Unit(ctx, "systoken", "u1")
+	if err != nil || unit.CourseId != "c1" || len(unit.Classroom) != 1 {
+		t.Errorf("got %#v, %v", unit, err)
+	}
+	_, err = client.Unit(ctx, "bad", "u1")
+	if apiErr, ok := err.(*backend.APIError); !ok || apiErr.Errmsg != "invalid token" {
+		t.Errorf("bad token: got %v, want APIError", err)
+	}
+	_, err = client.Unit(ctx, "systoken", "u9")
+	if _, ok := err.(*backend.APIError); !ok {
+		t.Errorf("not found: got %v, want APIError", err)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	identity, err := srv.APIClient().Identity(context.Background(), "systoken", "u1", "101")
+	if err != nil || identity.Identity != "1" {
+		t.Errorf("got %#v, %v", identity, err)
+	}
+}
+
+func TestIsPublicAndPremium(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	ctx := context.Background()
+	client := srv.APIClient()
+
+	if free, err := client.IsPublicAndPremium(ctx, "u1"); err != nil || !free {
+		t.Errorf("public and premium: got %v, %v", free, err)
+	}
+	if free, err := client.IsPublicAndPremium(ctx, "u2"); err != nil || free {
+		t.Errorf("public only: got %v, %v", free, err)
+	}
+	_, err := client.IsPublicAndPremium(ctx, "u3")
+	if _, ok := err.(*backend.DecodeError); !ok {
+		t.Errorf("missing course: got %v, want DecodeError", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+	ctx := context.Background()
+	client := srv.APIClient()
+
+	// 5xx重试
+	srv.FailNext(2)
+	before := srv.Requests()
+	if _, err := client.Course(ctx, "c1"); err != nil || srv.Requests()-before != 3 {
+		t.Errorf("retry: got %v after %d requests", err, srv.Requests()-before)
+	}
+	srv.FailNext(3)
+	_, err := client.Course(ctx, "c1")
+	if reqErr, ok := err.(*backend.RequestError); !ok || reqErr.StatusCode != 500 {
+		t.Errorf("retry exhausted: got %v, want RequestError 500", err)
+	}
+	srv.FailNext(0)
+
+	// 取消的请求不重试
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	before = srv.Requests()
+	_, err = client.Course(canceled, "c1")
+	if _, ok := err.(*backend.RequestError); !ok || srv.Requests() != before {
+		t.Errorf("canceled: got %v after %d requests", err, srv.Requests()-before)
+	}
+}
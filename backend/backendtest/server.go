@@ -0,0 +1,155 @@
+// 进程内的后端接口模拟服务，供离线测试ndscloud使用：
+//
+//	srv := backendtest.NewServer()
+//	defer srv.Close()
+//	srv.AddUnit(&backend.Unit{UnitId: "u1", CourseId: "c1"})
+//	client := srv.APIClient()
+package backendtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/darling-kefan/xj/backend"
+)
+
+type Server struct {
+	*httptest.Server
+
+	// 非空时校验需要token的接口
+	Token string
+
+	mutex      sync.Mutex
+	units      map[string]*backend.Unit
+	identities map[string]*backend.Identity // unitId:uid => 身份
+	courses    map[string]*backend.Course
+	responses  map[string]string // 路径 => 原样返回的响应体
+	failures   int
+	requests   int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		units:      make(map[string]*backend.Unit),
+		identities: make(map[string]*backend.Identity),
+		courses:    make(map[string]*backend.Course),
+		responses:  make(map[string]string),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// 指向模拟服务的客户端，不等待重试
+func (s *Server) APIClient() *backend.Client {
+	c := backend.New(s.URL)
+	c.UnitInfoApi = s.URL + "/v1/units/:unit_id/info"
+	c.RetryWait = 0
+	return c
+}
+
+func (s *Server) AddUnit(unit *backend.Unit) {
+	s.mutex.Lock()
+	s.units[unit.UnitId] = unit
+	s.mutex.Unlock()
+}
+
+func (s *Server) AddIdentity(unitId string, identity *backend.Identity) {
+	s.mutex.Lock()
+	s.identities[unitId+":"+identity.Uid] = identity
+	s.mutex.Unlock()
+}
+
+func (s *Server) AddCourse(course *backend.Course) {
+	s.mutex.Lock()
+	s.courses[course.CourseId] = course
+	s.mutex.Unlock()
+}
+
+// 对path的请求原样返回body，用于模拟格式错误的响应；body为空时恢复
+func (s *Server) SetResponse(path string, body string) {
+	s.mutex.Lock()
+	if body == "" {
+		delete(s.responses, path)
+	} else {
+		s.responses[path] = body
+	}
+	s.mutex.Unlock()
+}
+
+// 接下来n次请求返回500
+func (s *Server) FailNext(n int) {
+	s.mutex.Lock()
+	s.failures = n
+	s.mutex.Unlock()
+}
+
+// 已收到的请求数
+func (s *Server) Requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+// > GET /v1/units/:unit_id/get?token=
+// > GET /v1/units/:unit_id/info
+// > GET /v1/units/:unit_id/users/:uid/detail?token=
+// > GET /v1/courses/:course_id/detail
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requests++
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if body, ok := s.responses[r.URL.Path]; ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	authorized := s.Token == "" || r.URL.Query().Get("token") == s.Token
+	var (
+		data interface{}
+		ok   bool
+	)
+	switch {
+	case len(parts) == 4 && parts[1] == "units" && (parts[3] == "get" || parts[3] == "info"):
+		if parts[3] == "get" && !authorized {
+			reply(w, 1, "invalid token", nil)
+			return
+		}
+		data, ok = s.units[parts[2]]
+	case len(parts) == 6 && parts[1] == "units" && parts[3] == "users" && parts[5] == "detail":
+		if !authorized {
+			reply(w, 1, "invalid token", nil)
+			return
+		}
+		data, ok = s.identities[parts[2]+":"+parts[4]]
+	case len(parts) == 4 && parts[1] == "courses" && parts[3] == "detail":
+		data, ok = s.courses[parts[2]]
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !ok {
+		reply(w, 1, "not found", nil)
+		return
+	}
+	reply(w, 0, "OK", data)
+}
+
+func reply(w http.ResponseWriter, errcode int, errmsg string, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errcode": errcode,
+		"errmsg":  errmsg,
+		"data":    data,
+	})
+}
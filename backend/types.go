@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// 教室
+type Classroom struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// 单元信息
+type Unit struct {
+	CourseId       string      `json:"course_id"`
+	UnitId         string      `json:"unit_id"`
+	Type           string      `json:"type"`
+	Title          string      `json:"title"`
+	Desc           string      `json:"desc"`
+	Cover          string      `json:"cover"`
+	Status         string      `json:"status"`
+	EventId        string      `json:"event_id"`
+	StartTime      string      `json:"start_time"`
+	EndTime        string      `json:"end_time"`
+	CreatedAt      string      `json:"create_at"`
+	Classroom      []Classroom `json:"classroom,omitempty"`
+	ClassStartTime time.Time   `json:"class_start_time,omitempty"`
+	ClassEndTime   time.Time   `json:"class_end_time,omitempty"`
+}
+
+// 用户在课程中的身份
+type Identity struct {
+	Uid      string `json:"uid"`
+	Identity string `json:"identity"`
+	CourseId string `json:"course_id"`
+}
+
+// 课程详情
+type Course struct {
+	CourseId string `json:"course_id"`
+	Title    string `json:"title"`
+	Public   Flag   `json:"public"`
+	Premium  Flag   `json:"premium"`
+}
+
+// 接口中的开关字段，兼容 "1"、1、true 等写法
+type Flag bool
+
+func (f *Flag) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case bool:
+		*f = Flag(v)
+	case float64:
+		*f = v != 0
+	case string:
+		n, _ := strconv.Atoi(v)
+		*f = n != 0 || v == "true"
+	default:
+		*f = false
+	}
+	return nil
+}
+
+func (f Flag) MarshalJSON() ([]byte, error) {
+	if f {
+		return []byte(`"1"`), nil
+	}
+	return []byte(`"0"`), nil
+}
@@ -26,12 +26,15 @@ func main() {
 
 	router := gin.Default()
 
-	// /v2/units/:unit_id/scenes/list?token=:token
+	// /v2/units/:unit_id/scenes/list?token=:token&sort=:sort
 	// /v2/units/:unit_id/users?token=:access_token
 	// /v2/units/:unit_id/modules/status?token=:access_token
-	// /v2/units/:unit_id/modules/list?token=:access_token
+	// /v2/units/:unit_id/modules/list?token=:access_token&mod=:mod&from=:from&start_time=:ts&end_time=:ts&cursor=:id&limit=:limit
+	// /v2/units/:unit_id/scenes/:scene_id/modules/list?(同上)
 	// /v2/units/:unit_id/chat/message?token=:token&chat_id=:id&limit=:limit
+	// /v2/units/:unit_id/scenes/:scene_id/timeline?token=:token&cursor=:cursor&limit=:limit&format=ndjson
 	// /v2/ngx/center/units/:unit_id/?token=:access_token
+	// /v2/admin/... (Authorization: Bearer :admin_token)
 
 	hub := ndscloud.NewHub()
 	go hub.Run()
@@ -44,13 +47,40 @@ func main() {
 		})
 		v2.GET("units/:unit_id/modules/status", ndscloud.ServeModStatus)
 		v2.GET("units/:unit_id/modules/list", ndscloud.ServeModList)
+		v2.GET("units/:unit_id/scenes/:scene_id/modules/list", ndscloud.ServeModList)
 		v2.GET("units/:unit_id/chat/message", ndscloud.ServeChats)
+		v2.GET("units/:unit_id/scenes/:scene_id/timeline", ndscloud.ServeTimeline)
 		v2.GET("ngx/center/units/:unit_id/", func(c *gin.Context) {
 			//ndscloud.ServeWs(hub, c.Writer, c.Request)
 			ndscloud.ServeWs(hub, c)
 		})
 	}
 
+	admin := router.Group("/v2/admin", ndscloud.AdminAuth())
+	{
+		admin.GET("units", func(c *gin.Context) {
+			ndscloud.ServeAdminUnits(hub, c)
+		})
+		admin.GET("units/:unit_id/clients", func(c *gin.Context) {
+			ndscloud.ServeAdminClients(hub, c)
+		})
+		admin.GET("units/:unit_id/onlines", func(c *gin.Context) {
+			ndscloud.ServeAdminOnlines(hub, c)
+		})
+		admin.DELETE("units/:unit_id", func(c *gin.Context) {
+			ndscloud.ServeAdminTeardown(hub, c)
+		})
+		admin.POST("units/:unit_id/notice", func(c *gin.Context) {
+			ndscloud.ServeAdminNotice(hub, c)
+		})
+		admin.POST("units/:unit_id/end", func(c *gin.Context) {
+			ndscloud.ServeAdminEndUnit(hub, c)
+		})
+		admin.DELETE("clients/:client_id", func(c *gin.Context) {
+			ndscloud.ServeAdminKick(hub, c)
+		})
+	}
+
 	s := &http.Server{
 		Addr:           ":8081",
 		Handler:        router,
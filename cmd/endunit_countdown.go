@@ -29,13 +29,14 @@ import (
 	"time"
 
 	"github.com/gomodule/redigo/redis"
-	"github.com/gorilla/websocket"
 
 	"github.com/darling-kefan/xj/config"
-	"github.com/darling-kefan/xj/helper"
 )
 
 const (
+	// 结束单元信号频道，见ndscloud/endunit.go
+	endUnitChannel string = "nc:unit:end"
+
 	scanPrefix    string        = "nc:chan:unit:run:"
 	scanPeriod    time.Duration = 5 * time.Second
 	monitorPeriod time.Duration = 1 * time.Second
@@ -109,51 +110,18 @@ func scan(ctx context.Context) ([]string, error) {
 	return keys, nil
 }
 
-type EndUnitPacket struct {
-	Act  string `json:"act"`
-	From string `json:"from"`
-	Msg  struct {
-		Stat string `json:"stat"`
-	} `json:"msg"`
-}
-
 // 结束单元
-func endUnit(ctx context.Context, bus *Bus, unitid string, isEndCloud bool) error {
+func endUnit(ctx context.Context, bus *Bus, unitid, sceneid string, isEndCloud bool) error {
 	// redis实例
 	redconn := ctx.Value("redisPool").(*redis.Pool).Get()
-
-	// 获取token
-	token, err := helper.AccessToken(redconn, "client_credentials", nil)
-	if err != nil {
-		return err
-	}
+	defer redconn.Close()
 
 	if !isEndCloud {
-		// 通知云中控单元结束
-		wsapi := strings.Replace(strings.Replace(config.Config.Cc.Wsapi, ":unit_id", unitid, -1), ":token", token, -1)
-		c, _, err := websocket.DefaultDialer.Dial(wsapi, nil)
-		if err != nil {
-			log.Fatal("dial: ", err)
-		}
-		defer c.Close()
-
-		endunitPacket := EndUnitPacket{
-			Act:  "12",
-			From: "0:endunit_countdown.go",
-			Msg: struct {
-				Stat string `json:"stat"`
-			}{
-				Stat: "2",
-			},
-		}
-		b, err := json.Marshal(endunitPacket)
-		if err != nil {
+		// 通知云中控单元结束，由云中控记录场景结束时间并断开单元所有客户端
+		if _, err := redconn.Do("PUBLISH", endUnitChannel, unitid+":"+sceneid); err != nil {
 			return err
 		}
-		err = c.WriteMessage(websocket.TextMessage, []byte(b))
-		if err != nil {
-			log.Fatal(err)
-		}
+		log.Printf("PUBLISH %s %s:%s\n", endUnitChannel, unitid, sceneid)
 	}
 
 	// 通知Canvas单元结束
@@ -239,7 +207,7 @@ func monitor(ctx context.Context, bus *Bus) {
 				if ttl == -2 || (ttl >= 0 && 3600-ttl >= 3600) {
 					// 在监控中心移除该单元
 					bus.Remove(unitscene)
-					if err := endUnit(ctx, bus, unitid, isEndCloud); err != nil {
+					if err := endUnit(ctx, bus, unitid, sceneid, isEndCloud); err != nil {
 						log.Println(err)
 					}
 				}
@@ -44,6 +44,15 @@ type OAuth2 struct {
 	TokeninfoApi   string
 	ClientTokenKey string
 	PasswdTokenKey string
+
+	// 令牌验证方式：http(默认，调用TokeninfoApi) 或 jwt(本地验证签名)
+	Authenticator string
+	// 令牌信息缓存秒数，0不缓存；无效令牌缓存秒数，0不缓存
+	TokenCacheTTL    int
+	TokenNegativeTTL int
+	// jwt密钥，kid => 密钥。HS256为共享密钥，RS256为PEM公钥文件路径
+	JwtSecrets    map[string]string
+	JwtPublicKeys map[string]string
 }
 
 type Api struct {
@@ -53,8 +62,55 @@ type Api struct {
 }
 
 type Cc struct {
-	Domain string
-	Wsapi  string
+	Domain  string
+	Wsapi   string
+	Cluster bool   // 是否开启多实例集群(基于Redis pub/sub)
+	Node    string // 节点名称，为空时使用hostname:pid
+
+	// 客户端发送缓冲区大小，默认256
+	Outbound int
+	// 发送缓冲区满时的策略: drop_oldest, drop_newest, disconnect(默认)
+	Overflow string
+	// disconnect策略断开连接时使用的关闭码，默认4008
+	OverflowCloseCode int
+
+	// 单元消息补发缓冲区长度，默认1000
+	Replay int
+
+	// 管理接口令牌，为空时不开放管理接口
+	AdminToken string
+
+	// 在线记录(nc:onlines:*)的过期时间(秒)，由ping/pong续期，默认120
+	PresenceTTL int
+
+	// 断线后推送下线消息的宽限期(秒)，宽限期内重连不推送上线/下线消息，默认10，-1表示立即推送
+	OfflineGrace int
+
+	// 消息权限，act => 允许发送的角色(teacher, student, device, local_control)，覆盖默认权限
+	Permissions map[string][]string
+
+	// 限流，act => 令牌桶，"*"为所有act的总速率，"ink"为笔迹帧
+	RateLimits map[string]RateLimit
+	// 一分钟内超限多少次断开客户端，默认20，-1表示不断开
+	RateLimitStrikes int
+
+	// 敏感词词表文件，每行一个词，为空时不过滤；收到SIGHUP时重新加载
+	FilterWords string
+	// 过滤方式: mask(默认), reject, flag
+	FilterMode string
+	// 是否同时过滤普通消息(Act=6)
+	FilterOrdinary bool
+
+	// 注册后推送的同步消息(Act=22)中最近聊天消息的条数，默认20，-1表示不推送聊天消息
+	SyncChats int
+}
+
+// 令牌桶限流，Rate为每秒条数，0表示不限制
+type RateLimit struct {
+	Rate      float64 // 每个客户端
+	Burst     int
+	UnitRate  float64 // 每个单元
+	UnitBurst int
 }
 
 type Stat struct {
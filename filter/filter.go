@@ -0,0 +1,234 @@
+// 敏感词过滤：基于Aho–Corasick自动机按字符(rune)匹配，适用于无词边界的中文文本。
+// 英文字母不区分大小写。词表文件每行一个词，忽略空行及#开头的行。
+package filter
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 一次匹配，Start/End为文本中的字节位置
+type Match struct {
+	Word  string
+	Start int
+	End   int
+}
+
+type node struct {
+	next map[rune]int32
+	fail int32
+	// 以该节点结尾的词，-1表示无
+	word int32
+	// 失败链上最近的有词节点，-1表示无
+	dict int32
+	// 失败链上(含自身)最长词的字符数
+	longest int
+}
+
+// Aho–Corasick自动机，构建后只读，可并发使用
+type Matcher struct {
+	nodes []node
+	words []string
+}
+
+func NewMatcher(words []string) *Matcher {
+	m := &Matcher{nodes: []node{newNode()}}
+	for _, word := range words {
+		m.add(word)
+	}
+	m.build()
+	return m
+}
+
+func newNode() node {
+	return node{next: make(map[rune]int32), word: -1, dict: -1}
+}
+
+func (m *Matcher) add(word string) {
+	word = strings.TrimSpace(word)
+	if word == "" {
+		return
+	}
+	cur := int32(0)
+	for _, r := range word {
+		r = unicode.ToLower(r)
+		next, ok := m.nodes[cur].next[r]
+		if !ok {
+			next = int32(len(m.nodes))
+			m.nodes = append(m.nodes, newNode())
+			m.nodes[cur].next[r] = next
+		}
+		cur = next
+	}
+	if m.nodes[cur].word >= 0 {
+		return
+	}
+	m.nodes[cur].word = int32(len(m.words))
+	m.nodes[cur].longest = utf8.RuneCountInString(word)
+	m.words = append(m.words, word)
+}
+
+// 按层(广度优先)计算失败链
+func (m *Matcher) build() {
+	queue := make([]int32, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for r, child := range m.nodes[cur].next {
+			fail := m.nodes[cur].fail
+			for {
+				if next, ok := m.nodes[fail].next[r]; ok {
+					m.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = m.nodes[fail].fail
+			}
+			f := m.nodes[child].fail
+			if m.nodes[f].word >= 0 {
+				m.nodes[child].dict = f
+			} else {
+				m.nodes[child].dict = m.nodes[f].dict
+			}
+			if m.nodes[f].longest > m.nodes[child].longest {
+				m.nodes[child].longest = m.nodes[f].longest
+			}
+			queue = append(queue, child)
+		}
+	}
+}
+
+// 词表中的词数
+func (m *Matcher) Len() int {
+	return len(m.words)
+}
+
+func (m *Matcher) step(cur int32, r rune) int32 {
+	r = unicode.ToLower(r)
+	for {
+		if next, ok := m.nodes[cur].next[r]; ok {
+			return next
+		}
+		if cur == 0 {
+			return 0
+		}
+		cur = m.nodes[cur].fail
+	}
+}
+
+// 查找文本中出现的所有词(可重叠)
+func (m *Matcher) Match(text string) []Match {
+	var matches []Match
+	// 最近若干字符的起始字节位置，用于由字符数换算字节位置
+	starts := make([]int, 0, len(text))
+	cur := int32(0)
+	for i, r := range text {
+		starts = append(starts, i)
+		cur = m.step(cur, r)
+		end := i + utf8.RuneLen(r)
+		for n := cur; n >= 0; n = m.nodes[n].dict {
+			if w := m.nodes[n].word; w >= 0 {
+				word := m.words[w]
+				start := starts[len(starts)-utf8.RuneCountInString(word)]
+				matches = append(matches, Match{Word: word, Start: start, End: end})
+			}
+		}
+	}
+	return matches
+}
+
+// 是否包含词表中的词
+func (m *Matcher) Contains(text string) bool {
+	cur := int32(0)
+	for _, r := range text {
+		cur = m.step(cur, r)
+		if m.nodes[cur].longest > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// 将文本中出现的词逐字替换为mask
+func (m *Matcher) Mask(text string, mask rune) string {
+	runes := []rune(text)
+	masked := false
+	cur := int32(0)
+	for i, r := range runes {
+		cur = m.step(cur, r)
+		// 以该字符结尾的最长词覆盖了以其结尾的所有词
+		if n := m.nodes[cur].longest; n > 0 {
+			for j := i - n + 1; j <= i; j++ {
+				runes[j] = mask
+			}
+			masked = true
+		}
+	}
+	if !masked {
+		return text
+	}
+	return string(runes)
+}
+
+// 从文件加载词表的过滤器，可重新加载
+type Filter struct {
+	path string
+
+	mutex   sync.RWMutex
+	matcher *Matcher
+}
+
+func Load(path string) (*Filter, error) {
+	f := &Filter{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// 重新加载词表，失败时保留原词表
+func (f *Filter) Reload() error {
+	words, err := readWords(f.path)
+	if err != nil {
+		return err
+	}
+	matcher := NewMatcher(words)
+	f.mutex.Lock()
+	f.matcher = matcher
+	f.mutex.Unlock()
+	return nil
+}
+
+func (f *Filter) Matcher() *Matcher {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.matcher
+}
+
+func readWords(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	return words, scanner.Err()
+}
@@ -0,0 +1,48 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	cases := []struct {
+		text  string
+		match string // 匹配到的词，以逗号分隔
+		mask  string
+	}{
+		{text: "", match: "", mask: ""},
+		{text: "今天天气不错", match: "", mask: "今天天气不错"},
+		{text: "你是笨蛋吗", match: "笨蛋", mask: "你是**吗"},
+		{text: "大笨蛋", match: "大笨蛋,笨蛋", mask: "***"},
+		{text: "笨蛋笨蛋", match: "笨蛋,笨蛋", mask: "****"},
+		{text: "他说傻瓜蛋", match: "傻瓜,瓜蛋", mask: "他说***"},
+		{text: "SHIT happens", match: "shit", mask: "**** happens"},
+		{text: "ab abc bcd", match: "abc,bcd", mask: "ab *** ***"},
+		{text: "abcd", match: "abc,bcd", mask: "****"},
+		{text: "中abc文", match: "abc", mask: "中***文"},
+	}
+
+	matcher := NewMatcher([]string{"笨蛋", "大笨蛋", "傻瓜", "瓜蛋", "shit", "abc", "bcd", " ", ""})
+	for _, c := range cases {
+		c := c
+		t.Run(c.text, func(t *testing.T) {
+			words := make([]string, 0)
+			for _, m := range matcher.Match(c.text) {
+				if !strings.EqualFold(c.text[m.Start:m.End], m.Word) {
+					t.Errorf("match %q at [%d,%d)", m.Word, m.Start, m.End)
+				}
+				words = append(words, m.Word)
+			}
+			if got := strings.Join(words, ","); got != c.match {
+				t.Errorf("match %s, want %s", got, c.match)
+			}
+			if got := matcher.Mask(c.text, '*'); got != c.mask {
+				t.Errorf("mask %s, want %s", got, c.mask)
+			}
+			if got := matcher.Contains(c.text); got != (c.match != "") {
+				t.Errorf("contains %t, want %t", got, !got)
+			}
+		})
+	}
+}
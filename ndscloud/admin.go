@@ -0,0 +1,215 @@
+package ndscloud
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+	"github.com/gin-gonic/gin"
+)
+
+// 管理接口：查看及控制本节点的在线会话
+// > GET    /v2/admin/units                    在线单元
+// > GET    /v2/admin/units/:unit_id/clients   单元在线客户端
+// > GET    /v2/admin/units/:unit_id/onlines   单元在线记录(所有节点，见presence.go)
+// > DELETE /v2/admin/units/:unit_id           断开单元所有客户端
+// > POST   /v2/admin/units/:unit_id/notice    向单元广播系统通知
+// > POST   /v2/admin/units/:unit_id/end       结束单元(见endunit.go)，可选参数scene_id
+// > DELETE /v2/admin/clients/:client_id       断开客户端(开启集群时同时通知其它节点)
+// 请求需携带 Authorization: Bearer <Cc.AdminToken>
+
+type adminUnit struct {
+	UnitId  string `json:"unit_id"`
+	Clients int    `json:"clients"`
+	Locals  int    `json:"locals"`
+}
+
+type adminClient struct {
+	Id           string `json:"id"`
+	Type         string `json:"type"`
+	Identity     int    `json:"identity"`
+	Classroom    string `json:"classroom"`
+	RegisteredAt int64  `json:"registered_at"`
+	Queue        int    `json:"queue"`
+	Dropped      int64  `json:"dropped"`
+	Resuming     bool   `json:"resuming"`
+	Addr         string `json:"addr"`
+}
+
+// 管理接口鉴权
+func AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := config.Config.Cc.AdminToken
+		if token == "" {
+			outputJson(c, 1, "admin api disabled", nil)
+			c.Abort()
+			return
+		}
+		auth := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+			outputJson(c, 1, "invalid admin token", nil)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 在线单元
+func ServeAdminUnits(hub *Hub, c *gin.Context) {
+	list := make([]adminUnit, 0)
+	for _, unitId := range hub.units() {
+		room := hub.room(unitId)
+		if room == nil {
+			continue
+		}
+		room.mutex.RLock()
+		list = append(list, adminUnit{UnitId: unitId, Clients: len(room.clients), Locals: len(room.cache.Loc)})
+		room.mutex.RUnlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UnitId < list[j].UnitId })
+
+	outputJson(c, 0, "OK", gin.H{
+		"node":  hub.node(),
+		"total": len(list),
+		"list":  list,
+	})
+}
+
+// 单元在线客户端，含发送缓冲区积压的消息数及注册时间
+func ServeAdminClients(hub *Hub, c *gin.Context) {
+	list := make([]adminClient, 0)
+	if room := hub.room(c.Param("unit_id")); room != nil {
+		list = adminClientsOf(room)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RegisteredAt < list[j].RegisteredAt })
+
+	outputJson(c, 0, "OK", gin.H{
+		"node":  hub.node(),
+		"total": len(list),
+		"list":  list,
+	})
+}
+
+// 注册时间由客户端goroutine在Room锁内写入(见Hub.setRegistered)，须在锁内读取
+func adminClientsOf(room *Room) []adminClient {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+
+	list := make([]adminClient, 0, len(room.clients))
+	for _, client := range room.clients {
+		item := adminClient{
+			Id:           client.id,
+			Type:         "user",
+			Identity:     client.identity,
+			Classroom:    client.classroom(),
+			RegisteredAt: client.registeredAt / int64(time.Second),
+			Queue:        client.queueDepth(),
+			Dropped:      client.droppedCount(),
+			Resuming:     client.isResuming(),
+			Addr:         client.conn.RemoteAddr().String(),
+		}
+		if client.isLocalControl() {
+			item.Type = "local_control"
+		} else if client.isDevice() {
+			item.Type = "device"
+		}
+		list = append(list, item)
+	}
+	return list
+}
+
+// 单元在线记录
+func ServeAdminOnlines(hub *Hub, c *gin.Context) {
+	list, err := hub.onlines(c.Param("unit_id"))
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RegisteredAt < list[j].RegisteredAt })
+
+	outputJson(c, 0, "OK", gin.H{
+		"total": len(list),
+		"list":  list,
+	})
+}
+
+// 断开客户端
+func ServeAdminKick(hub *Hub, c *gin.Context) {
+	id := c.Param("client_id")
+	client := hub.get(id)
+	if client == nil && hub.cluster == nil {
+		outputJson(c, 1, "client not found", nil)
+		return
+	}
+	if client != nil {
+		client.send(errorReply("", "", ErrKicked))
+		client.setClose(closeKicked, "kicked")
+		hub.unregister <- client
+	}
+	if hub.cluster != nil {
+		hub.cluster.kick(id)
+	}
+	log.Printf("[admin] Kick %s\n", id)
+	outputJson(c, 0, "OK", nil)
+}
+
+// 断开单元所有客户端
+func ServeAdminTeardown(hub *Hub, c *gin.Context) {
+	unitId := c.Param("unit_id")
+	if hub.room(unitId) == nil {
+		outputJson(c, 1, "unit not found", nil)
+		return
+	}
+	hub.teardown <- unitId
+	log.Printf("[admin] Tear down unit %s\n", unitId)
+	outputJson(c, 0, "OK", nil)
+}
+
+// 向单元广播系统通知
+func ServeAdminNotice(hub *Hub, c *gin.Context) {
+	unitId := c.Param("unit_id")
+	var req struct {
+		Msg string `json:"msg"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil || req.Msg == "" {
+		outputJson(c, 1, "missing param msg", nil)
+		return
+	}
+	if hub.room(unitId) == nil {
+		outputJson(c, 1, "unit not found", nil)
+		return
+	}
+	hub.dispatch(&SysNoticeMsg{
+		Act:       "18",
+		Msg:       req.Msg,
+		CreatedAt: time.Now().Unix(),
+		Route:     Route{Unit: unitId},
+	})
+	log.Printf("[admin] Notice %s: %s\n", unitId, req.Msg)
+	outputJson(c, 0, "OK", nil)
+}
+
+// 结束单元
+func ServeAdminEndUnit(hub *Hub, c *gin.Context) {
+	unitId := c.Param("unit_id")
+	sceneId := 0
+	if c.Query("scene_id") != "" {
+		var err error
+		if sceneId, err = strconv.Atoi(c.Query("scene_id")); err != nil {
+			outputJson(c, 1, "invalid param scene_id", nil)
+			return
+		}
+	}
+	if err := hub.EndUnit(unitId, sceneId); err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	log.Printf("[admin] End unit %s\n", unitId)
+	outputJson(c, 0, "OK", nil)
+}
@@ -0,0 +1,67 @@
+package ndscloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// 建立一条websocket连接，返回客户端一侧的连接
+func dialTestConn(t *testing.T) (*websocket.Conn, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		srv.Close()
+	}
+}
+
+// 注册与admin接口并发读取注册时间(go test -race)
+func TestAdminClientsOf(t *testing.T) {
+	conn, closeConn := dialTestConn(t)
+	defer closeConn()
+
+	hub := NewHub()
+	c := newTestClient(hub, "u1", "s1", nil, 0)
+	c.conn = conn
+	c.isRegistered = false
+	hub.add(c)
+	room := hub.room("u1")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.setRegistered(c)
+	}()
+	for i := 0; i < 100; i++ {
+		if list := adminClientsOf(room); len(list) != 1 || list[0].Id != "s1" || list[0].Identity != 2 {
+			t.Fatalf("got %+v", list)
+		}
+	}
+	wg.Wait()
+
+	list := adminClientsOf(room)
+	if list[0].RegisteredAt == 0 || list[0].Type != "user" {
+		t.Errorf("got %+v", list[0])
+	}
+}
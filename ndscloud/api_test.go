@@ -0,0 +1,139 @@
+package ndscloud
+
+import (
+	"context"
+	"testing"
+
+	"github.com/darling-kefan/xj/backend"
+	"github.com/darling-kefan/xj/backend/backendtest"
+)
+
+// 将后端接口指向模拟服务，返回恢复函数
+func setTestBackend() (*backendtest.Server, func()) {
+	srv := backendtest.NewServer()
+	srv.Token = "systoken"
+	srv.AddUnit(&backend.Unit{UnitId: "u1", CourseId: "c1", Title: "unit", Classroom: []backend.Classroom{{Id: "r1", Title: "room"}}})
+	srv.AddUnit(&backend.Unit{UnitId: "u2", CourseId: "c2"})
+	srv.AddIdentity("u1", &backend.Identity{Uid: "101", Identity: "1", CourseId: "c1"})
+	srv.AddCourse(&backend.Course{CourseId: "c1", Public: true, Premium: true})
+	srv.AddCourse(&backend.Course{CourseId: "c2", Public: true})
+
+	prev := getBackend()
+	SetBackend(srv.APIClient())
+	return srv, func() {
+		SetBackend(prev)
+		srv.Close()
+	}
+}
+
+func TestGetUnitInfo(t *testing.T) {
+	srv, restore := setTestBackend()
+	defer restore()
+	ctx := context.Background()
+
+	unitInfo, err := getUnitInfo(ctx, "systoken", "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unitInfo.CourseId != "c1" || unitInfo.Title != "unit" || len(unitInfo.Classroom) != 1 || unitInfo.Classroom[0] != (ClassroomInfo{Id: "r1", Title: "room"}) {
+		t.Errorf("got %#v", unitInfo)
+	}
+	if _, err := getUnitInfo(ctx, "bad", "u1"); err == nil {
+		t.Error("bad token: got nil error")
+	}
+	if _, err := getUnitInfo(ctx, "systoken", "u9"); err == nil {
+		t.Error("unknown unit: got nil error")
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not json", `<html>bad gateway</html>`},
+		{"null data", `{"errcode":0,"errmsg":"OK","data":null}`},
+		{"missing data", `{"errcode":0,"errmsg":"OK"}`},
+		{"data not object", `{"errcode":0,"errmsg":"OK","data":"u1"}`},
+		{"classroom not array", `{"errcode":0,"errmsg":"OK","data":{"unit_id":"u1","classroom":"r1"}}`},
+	}
+	for _, tt := range tests {
+		srv.SetResponse("/v1/units/u1/get", tt.body)
+		if unitInfo, err := getUnitInfo(ctx, "systoken", "u1"); err == nil {
+			t.Errorf("%s: got %#v, want error", tt.name, unitInfo)
+		}
+	}
+}
+
+func TestGetUnitidt(t *testing.T) {
+	srv, restore := setTestBackend()
+	defer restore()
+	ctx := context.Background()
+
+	unitidt, err := getUnitidt(ctx, "systoken", "u1", "101")
+	if err != nil || *unitidt != (CourseIdentity{Uid: "101", Identity: "1", CourseId: "c1"}) {
+		t.Errorf("got %#v, %v", unitidt, err)
+	}
+	if _, err := getUnitidt(ctx, "systoken", "u1", "102"); err == nil {
+		t.Error("unknown user: got nil error")
+	}
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"not json", `not json`},
+		{"null data", `{"errcode":0,"errmsg":"OK","data":null}`},
+		{"data not object", `{"errcode":0,"errmsg":"OK","data":[1]}`},
+		{"identity not string", `{"errcode":0,"errmsg":"OK","data":{"uid":"101","identity":1}}`},
+	}
+	for _, tt := range tests {
+		srv.SetResponse("/v1/units/u1/users/101/detail", tt.body)
+		if unitidt, err := getUnitidt(ctx, "systoken", "u1", "101"); err == nil {
+			t.Errorf("%s: got %#v, want error", tt.name, unitidt)
+		}
+	}
+}
+
+func TestIsPublicAndPremium(t *testing.T) {
+	srv, restore := setTestBackend()
+	defer restore()
+	ctx := context.Background()
+
+	if ok, err := isPublicAndPremium(ctx, "u1"); err != nil || !ok {
+		t.Errorf("public and premium: got %v, %v", ok, err)
+	}
+	if ok, err := isPublicAndPremium(ctx, "u2"); err != nil || ok {
+		t.Errorf("public only: got %v, %v", ok, err)
+	}
+	if _, err := isPublicAndPremium(ctx, "u9"); err == nil {
+		t.Error("unknown unit: got nil error")
+	}
+
+	// 以下响应曾导致类型断言panic
+	tests := []struct {
+		name string
+		path string
+		body string
+	}{
+		{"null unit", "/v1/units/u1/info", `{"errcode":0,"errmsg":"OK","data":null}`},
+		{"unit not object", "/v1/units/u1/info", `{"errcode":0,"errmsg":"OK","data":"c1"}`},
+		{"missing course_id", "/v1/units/u1/info", `{"errcode":0,"errmsg":"OK","data":{"unit_id":"u1"}}`},
+		{"course_id not string", "/v1/units/u1/info", `{"errcode":0,"errmsg":"OK","data":{"course_id":1}}`},
+		{"null course", "/v1/courses/c1/detail", `{"errcode":0,"errmsg":"OK","data":null}`},
+		{"course not object", "/v1/courses/c1/detail", `{"errcode":0,"errmsg":"OK","data":true}`},
+		{"course not json", "/v1/courses/c1/detail", `{"errcode":0,`},
+	}
+	for _, tt := range tests {
+		srv.SetResponse(tt.path, tt.body)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("%s: panic %v", tt.name, r)
+				}
+			}()
+			if ok, err := isPublicAndPremium(ctx, "u1"); err == nil {
+				t.Errorf("%s: got %v, want error", tt.name, ok)
+			}
+		}()
+		srv.SetResponse(tt.path, "")
+	}
+}
@@ -0,0 +1,364 @@
+package ndscloud
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+)
+
+// 令牌验证，结果为*UserInfo(用户)或*DeviceInfo(设备)：
+// > HTTPAuthenticator   调用OAuth2.TokeninfoApi验证
+// > CachedAuthenticator 缓存验证结果，无效令牌同样缓存
+// > JWTAuthenticator    使用配置的密钥本地验证jwt签名
+// > StaticAuthenticator 内存中的固定令牌，用于测试
+// 由OAuth2.Authenticator选择，OAuth2.TokenCacheTTL/TokenNegativeTTL大于0时开启缓存
+
+// 无效令牌，可缓存
+var ErrInvalidToken = errors.New("Invalid token.")
+
+type Authenticator interface {
+	Authenticate(token string) (interface{}, error)
+}
+
+var (
+	authOnce      sync.Once
+	authenticator Authenticator
+)
+
+// 替换令牌验证方式，须在处理请求前调用
+func SetAuthenticator(a Authenticator) {
+	authOnce.Do(func() {})
+	authenticator = a
+}
+
+func defaultAuthenticator() Authenticator {
+	authOnce.Do(func() {
+		authenticator = newAuthenticator(config.Config.OAuth2)
+	})
+	return authenticator
+}
+
+// 根据配置创建令牌验证
+func newAuthenticator(conf config.OAuth2) Authenticator {
+	switch conf.Authenticator {
+	case "jwt":
+		a, err := NewJWTAuthenticator(conf.JwtSecrets, conf.JwtPublicKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return a
+	case "", "http":
+		var a Authenticator = NewHTTPAuthenticator(conf.TokeninfoApi)
+		if conf.TokenCacheTTL > 0 || conf.TokenNegativeTTL > 0 {
+			a = NewCachedAuthenticator(a, time.Duration(conf.TokenCacheTTL)*time.Second, time.Duration(conf.TokenNegativeTTL)*time.Second)
+		}
+		return a
+	}
+	log.Fatalf("Unknown authenticator %s\n", conf.Authenticator)
+	return nil
+}
+
+// 验证令牌
+func getTokenInfo(token string) (interface{}, error) {
+	return defaultAuthenticator().Authenticate(token)
+}
+
+// 解析令牌信息：含uid为用户，含client_id且配置了设备类型为设备
+func parseTokenInfo(body []byte) (interface{}, error) {
+	var flagStruct struct {
+		Uid      string `json:"uid"`
+		ClientId string `json:"client_id"`
+	}
+	if err := json.Unmarshal(body, &flagStruct); err != nil {
+		return nil, err
+	}
+
+	if flagStruct.Uid != "" {
+		var userInfo UserInfo
+		if err := json.Unmarshal(body, &userInfo); err != nil {
+			return nil, err
+		}
+		return &userInfo, nil
+	} else if flagStruct.ClientId != "" {
+		var deviceInfo DeviceInfo
+		if err := json.Unmarshal(body, &deviceInfo); err != nil {
+			return nil, err
+		}
+		if deviceInfo.Config.Device.DeviceType != 0 {
+			return &deviceInfo, nil
+		}
+	}
+
+	return nil, ErrInvalidToken
+}
+
+// 复制令牌信息，注册时会修改客户端的令牌信息(Vi/Hw/Dt等)，缓存的信息不能共享
+func copyTokenInfo(info interface{}) interface{} {
+	switch v := info.(type) {
+	case *UserInfo:
+		userInfo := *v
+		return &userInfo
+	case *DeviceInfo:
+		deviceInfo := *v
+		return &deviceInfo
+	}
+	return info
+}
+
+// 令牌对应的用户id或设备id
+func tokenId(info interface{}) string {
+	switch v := info.(type) {
+	case *UserInfo:
+		return v.Uid
+	case *DeviceInfo:
+		return v.ClientId
+	}
+	return ""
+}
+
+// --------------------------------------------------------------------
+
+// 调用TokeninfoApi验证令牌
+type HTTPAuthenticator struct {
+	Api    string
+	Client *http.Client
+}
+
+func NewHTTPAuthenticator(api string) *HTTPAuthenticator {
+	return &HTTPAuthenticator{Api: api, Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (a *HTTPAuthenticator) Authenticate(token string) (interface{}, error) {
+	resp, err := a.Client.Get(a.Api + "?token=" + url.QueryEscape(token))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, fmt.Errorf("tokeninfo api: %s", resp.Status)
+	}
+	return parseTokenInfo(body)
+}
+
+// --------------------------------------------------------------------
+
+// 缓存条目上限，超出时先清理过期条目，仍超出则清空
+const authCacheSize = 10000
+
+// 缓存令牌验证结果。有效令牌缓存ttl，无效令牌(ErrInvalidToken)缓存negativeTTL，
+// 其它错误(如网络错误)不缓存
+type CachedAuthenticator struct {
+	next        Authenticator
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*authEntry
+}
+
+type authEntry struct {
+	info    interface{}
+	err     error
+	expires time.Time
+}
+
+func NewCachedAuthenticator(next Authenticator, ttl, negativeTTL time.Duration) *CachedAuthenticator {
+	return &CachedAuthenticator{
+		next:        next,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]*authEntry),
+	}
+}
+
+func (a *CachedAuthenticator) Authenticate(token string) (interface{}, error) {
+	now := time.Now()
+	a.mutex.Lock()
+	entry, ok := a.entries[token]
+	a.mutex.Unlock()
+	if ok && now.Before(entry.expires) {
+		return copyTokenInfo(entry.info), entry.err
+	}
+
+	info, err := a.next.Authenticate(token)
+	ttl := a.ttl
+	if err == ErrInvalidToken {
+		ttl = a.negativeTTL
+	} else if err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return info, err
+	}
+
+	a.mutex.Lock()
+	if len(a.entries) >= authCacheSize {
+		a.purgeLocked(now)
+	}
+	a.entries[token] = &authEntry{info: copyTokenInfo(info), err: err, expires: now.Add(ttl)}
+	a.mutex.Unlock()
+	return info, err
+}
+
+func (a *CachedAuthenticator) purgeLocked(now time.Time) {
+	for token, entry := range a.entries {
+		if !now.Before(entry.expires) {
+			delete(a.entries, token)
+		}
+	}
+	if len(a.entries) >= authCacheSize {
+		a.entries = make(map[string]*authEntry)
+	}
+}
+
+// --------------------------------------------------------------------
+
+// 本地验证jwt令牌，支持HS256和RS256。header中的kid指定密钥，无kid时逐个尝试；
+// payload与TokeninfoApi的返回格式相同，另校验exp和nbf，没有exp的令牌无效
+type JWTAuthenticator struct {
+	secrets    map[string][]byte
+	publicKeys map[string]*rsa.PublicKey
+}
+
+// secrets: kid => 共享密钥；publicKeyFiles: kid => PEM公钥文件路径
+func NewJWTAuthenticator(secrets map[string]string, publicKeyFiles map[string]string) (*JWTAuthenticator, error) {
+	a := &JWTAuthenticator{
+		secrets:    make(map[string][]byte),
+		publicKeys: make(map[string]*rsa.PublicKey),
+	}
+	for kid, secret := range secrets {
+		a.secrets[kid] = []byte(secret)
+	}
+	for kid, path := range publicKeyFiles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseRSAPublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %s: %s", kid, err)
+		}
+		a.publicKeys[kid] = key
+	}
+	if len(a.secrets) == 0 && len(a.publicKeys) == 0 {
+		return nil, errors.New("no jwt keys configured")
+	}
+	return a, nil
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return key, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(token string) (interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !a.verify(header.Alg, header.Kid, parts[0]+"."+parts[1], sig) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+		Nbf int64 `json:"nbf"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now().Unix()
+	if claims.Exp == 0 || now >= claims.Exp || (claims.Nbf != 0 && now < claims.Nbf) {
+		return nil, ErrInvalidToken
+	}
+	return parseTokenInfo(payload)
+}
+
+func (a *JWTAuthenticator) verify(alg, kid, signed string, sig []byte) bool {
+	switch alg {
+	case "HS256":
+		for k, secret := range a.secrets {
+			if kid != "" && k != kid {
+				continue
+			}
+			mac := hmac.New(sha256.New, secret)
+			mac.Write([]byte(signed))
+			if hmac.Equal(sig, mac.Sum(nil)) {
+				return true
+			}
+		}
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		for k, key := range a.publicKeys {
+			if kid != "" && k != kid {
+				continue
+			}
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// --------------------------------------------------------------------
+
+// 固定令牌，token => *UserInfo 或 *DeviceInfo，用于测试
+type StaticAuthenticator map[string]interface{}
+
+func (a StaticAuthenticator) Authenticate(token string) (interface{}, error) {
+	if info, ok := a[token]; ok {
+		return copyTokenInfo(info), nil
+	}
+	return nil, ErrInvalidToken
+}
@@ -0,0 +1,118 @@
+package ndscloud
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// 记录调用次数的令牌验证
+type countingAuthenticator struct {
+	Authenticator
+	calls int
+}
+
+func (a *countingAuthenticator) Authenticate(token string) (interface{}, error) {
+	a.calls++
+	return a.Authenticator.Authenticate(token)
+}
+
+func testStaticAuthenticator() StaticAuthenticator {
+	return StaticAuthenticator{
+		"user-token":   &UserInfo{Uid: "u1"},
+		"device-token": &DeviceInfo{ClientId: "d1"},
+	}
+}
+
+// 生成HS256签名的jwt
+func signJWT(secret, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	static := testStaticAuthenticator()
+
+	info, err := static.Authenticate("user-token")
+	if user, ok := info.(*UserInfo); err != nil || !ok || user.Uid != "u1" {
+		t.Errorf("user-token: got %#v, %v", info, err)
+	}
+	info, err = static.Authenticate("device-token")
+	if device, ok := info.(*DeviceInfo); err != nil || !ok || device.ClientId != "d1" {
+		t.Errorf("device-token: got %#v, %v", info, err)
+	}
+	if _, err := static.Authenticate("bad"); err != ErrInvalidToken {
+		t.Errorf("bad: got %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestCachedAuthenticator(t *testing.T) {
+	// 有效及无效令牌各只验证一次，返回的信息互不影响
+	next := &countingAuthenticator{Authenticator: testStaticAuthenticator()}
+	cached := NewCachedAuthenticator(next, time.Minute, time.Minute)
+	a, _ := cached.Authenticate("user-token")
+	a.(*UserInfo).Vi = "1"
+	b, _ := cached.Authenticate("user-token")
+	if next.calls != 1 {
+		t.Errorf("got %d calls, want 1", next.calls)
+	}
+	if b.(*UserInfo).Vi != "" {
+		t.Errorf("cached info modified by caller")
+	}
+	cached.Authenticate("bad")
+	if _, err := cached.Authenticate("bad"); next.calls != 2 || err != ErrInvalidToken {
+		t.Errorf("negative cache: got %d calls, %v", next.calls, err)
+	}
+
+	// 无效令牌不缓存
+	next = &countingAuthenticator{Authenticator: testStaticAuthenticator()}
+	cached = NewCachedAuthenticator(next, time.Minute, 0)
+	cached.Authenticate("bad")
+	cached.Authenticate("bad")
+	if next.calls != 2 {
+		t.Errorf("no negative cache: got %d calls, want 2", next.calls)
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	jwt, err := NewJWTAuthenticator(map[string]string{"k1": "secret1", "k2": "secret2"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	info, err := jwt.Authenticate(signJWT("secret1", "k1", map[string]interface{}{"uid": "u1", "exp": exp}))
+	if user, ok := info.(*UserInfo); err != nil || !ok || user.Uid != "u1" {
+		t.Errorf("user: got %#v, %v", info, err)
+	}
+	info, err = jwt.Authenticate(signJWT("secret2", "", map[string]interface{}{
+		"client_id": "d1",
+		"exp":       exp,
+		"config":    map[string]interface{}{"device": map[string]interface{}{"device_type": 2}},
+	}))
+	if device, ok := info.(*DeviceInfo); err != nil || !ok || device.ClientId != "d1" {
+		t.Errorf("device without kid: got %#v, %v", info, err)
+	}
+
+	invalid := map[string]string{
+		"wrong kid":           signJWT("secret1", "k2", map[string]interface{}{"uid": "u1", "exp": exp}),
+		"bad signature":       signJWT("secret3", "", map[string]interface{}{"uid": "u1", "exp": exp}),
+		"expired":             signJWT("secret1", "k1", map[string]interface{}{"uid": "u1", "exp": time.Now().Unix() - 1}),
+		"without exp":         signJWT("secret1", "k1", map[string]interface{}{"uid": "u1"}),
+		"not yet valid":       signJWT("secret1", "k1", map[string]interface{}{"uid": "u1", "exp": exp, "nbf": exp}),
+		"device without type": signJWT("secret1", "k1", map[string]interface{}{"client_id": "d1", "exp": exp}),
+		"malformed":           "not.a.token",
+	}
+	for name, token := range invalid {
+		if _, err := jwt.Authenticate(token); err != ErrInvalidToken {
+			t.Errorf("%s: got %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 文字聊天：
+// > Act=15 聊天消息，to为空或指向所有终端(如 "A")时单元所有终端可见，包括之后加入的终端；
+//          否则为私聊/定向消息(如 "T" 仅老师可见)，可见者为发送时的接收者；
+//          at为@的终端id；chat_id由服务端分配，即消息在nc:chat:his:{unit}:{scene}中的位置(从1开始)，与消息一并保存
+// > Act=19 撤回，发送者或老师可撤回，原消息替换为墓碑，ServeChats中可见
+// > Act=20 禁言，由老师发送，uid为空时禁言全体(老师除外)，mute为false时解除
+
+const (
+	// 聊天消息最大长度(字节)
+	maxChatText = 100
+	// 一条消息最多@的终端数
+	maxMentions = 20
+	// 禁言全体的字段
+	muteAll = "*"
+	// 同时撤回冲突时的重试次数
+	chatRecallRetries = 5
+)
+
+// 聊天记录
+type chatRecord struct {
+	ChatTextMsg
+	// 发送者(本地终端的消息为其本地中控)
+	Sender string `json:"sender,omitempty"`
+	// 定向消息的可见者(含发送者)，为空时所有人可见
+	Visible    []string `json:"visible,omitempty"`
+	Recalled   bool     `json:"recalled,omitempty"`
+	RecalledBy string   `json:"recalled_by,omitempty"`
+	RecalledAt int64    `json:"recalled_at,omitempty"`
+}
+
+// 该记录是否对id可见
+func (r *chatRecord) visibleTo(id string) bool {
+	if len(r.Visible) == 0 {
+		return true
+	}
+	for _, v := range r.Visible {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// 聊天消息Act=15
+func validateChatText(c *Client, m Message) error {
+	message := m.(*ChatTextMsg)
+	msg, _ := message.Msg.(map[string]interface{})
+	text, ok := msg["c"].(string)
+	if !ok {
+		return NewError(ErrCodeMissingField, "field 'msg.c' not exists, discard message")
+	}
+	if len(text) > maxChatText {
+		return NewError(ErrCodeTooLong, "chat message too long")
+	}
+	if len(message.At) > maxMentions {
+		return NewError(ErrCodeTooLong, "too many mentions")
+	}
+	if message.To != "" {
+		if _, err := ParseToInUnit(message.To, c.unitInfo); err != nil {
+			return err
+		}
+	}
+
+	muted, err := c.chatMuted(message.From)
+	if err != nil {
+		return storageError(err)
+	}
+	if muted {
+		return NewError(ErrCodeMuted, "muted by teacher")
+	}
+	return nil
+}
+
+func handleChatText(c *Client, m Message) error {
+	message := m.(*ChatTextMsg)
+	message.ChatId = 0
+	message.CreatedAt = time.Now().Unix()
+	message.At = uniqueIds(message.At)
+	if message.To == "" {
+		return nil
+	}
+	// 发送给所有终端的消息不限定可见者，之后加入的终端也可见
+	if expr, err := ParseTo(message.To); err == nil && toAll(expr) {
+		return nil
+	}
+
+	// 定向消息只能@其接收者
+	message.visible = c.chatVisible(message.To)
+	for _, id := range message.At {
+		if i := sort.SearchStrings(message.visible, id); i == len(message.visible) || message.visible[i] != id {
+			return NewError(ErrCodeBadMention, "mentioned %s is not a receiver", id)
+		}
+	}
+	return nil
+}
+
+// 追加聊天记录，chat_id即记录在列表中的位置(从1开始)，写入记录后返回
+// KEYS[1]: chat key
+// ARGV[1]: 不含chat_id的记录
+var appendChatScript = redis.NewScript(1, `
+local n = redis.call('LLEN', KEYS[1]) + 1
+redis.call('RPUSH', KEYS[1], '{"chat_id":' .. n .. ',' .. string.sub(ARGV[1], 2))
+return n
+`)
+
+// 持久化聊天消息，并分配chat_id
+func persistChatText(c *Client, m Message) error {
+	message := m.(*ChatTextMsg)
+	record := &chatRecord{ChatTextMsg: *message, Sender: c.id, Visible: message.visible}
+	storedMsg, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("[%s] Failed to json.Marshal: %s\n", c.id, err)
+		return NewError(ErrCodeBadFormat, "Json format error")
+	}
+	chatKey := fmt.Sprintf(chatKeyFormat, c.unitId, c.unitInfo.SceneId)
+	n, err := redis.Int64(appendChatScript.Do(c.redconn, chatKey, storedMsg))
+	if err != nil {
+		return storageError(err)
+	}
+	message.ChatId = n
+	log.Printf("[%s] RPUSH %s chat %d %s\n", c.id, chatKey, n, string(storedMsg))
+	return nil
+}
+
+// 撤回聊天消息Act=19，撤回消息转发给原消息的接收者。
+// 读取及替换记录使用WATCH/MULTI，避免同时撤回时互相覆盖
+func handleChatRecall(c *Client, m Message) error {
+	message := m.(*ChatRecallMsg)
+	if message.ChatId <= 0 {
+		return NewError(ErrCodeMissingField, "field 'chat_id' not exists, discard message")
+	}
+
+	chatKey := fmt.Sprintf(chatKeyFormat, c.unitId, c.unitInfo.SceneId)
+	for i := 0; i < chatRecallRetries; i++ {
+		if _, err := c.redconn.Do("WATCH", chatKey); err != nil {
+			return storageError(err)
+		}
+		record, err := c.recallableChat(chatKey, message.ChatId)
+		if err != nil {
+			c.redconn.Do("UNWATCH")
+			return err
+		}
+
+		// 墓碑：保留发送者及可见者，删除内容
+		now := time.Now().Unix()
+		record.Msg = nil
+		record.At = nil
+		record.Recalled = true
+		record.RecalledBy = c.id
+		record.RecalledAt = now
+		b, _ := json.Marshal(record)
+
+		c.redconn.Send("MULTI")
+		c.redconn.Send("LSET", chatKey, message.ChatId-1, b)
+		reply, err := c.redconn.Do("EXEC")
+		if err != nil {
+			return storageError(err)
+		}
+		if reply == nil {
+			// 其它终端同时修改了聊天记录，重新读取
+			log.Printf("[%s] Concurrent update on %s, retry\n", c.id, chatKey)
+			continue
+		}
+		log.Printf("[%s] LSET %s %d %s\n", c.id, chatKey, message.ChatId-1, b)
+
+		// 发送给原消息的可见者
+		message.To = strings.Join(record.Visible, ",")
+		message.CreatedAt = now
+		return nil
+	}
+	return NewError(ErrCodeConflict, "too many concurrent updates on chat %d", message.ChatId)
+}
+
+// 读取待撤回的聊天记录，并校验撤回权限
+func (c *Client) recallableChat(chatKey string, chatId int64) (*chatRecord, error) {
+	b, err := redis.Bytes(c.redconn.Do("LINDEX", chatKey, chatId-1))
+	if err == redis.ErrNil {
+		return nil, NewError(ErrCodeNotFound, "chat %d not found", chatId)
+	}
+	if err != nil {
+		return nil, storageError(err)
+	}
+	record := new(chatRecord)
+	if err := json.Unmarshal(b, record); err != nil {
+		return nil, storageError(err)
+	}
+	if record.Recalled {
+		return nil, NewError(ErrCodeNotFound, "chat %d already recalled", chatId)
+	}
+	if record.Sender != c.id && c.role() != RoleTeacher {
+		return nil, NewError(ErrCodeUnauthorizedAct, "only the sender or a teacher can recall chat %d", chatId)
+	}
+	return record, nil
+}
+
+// 禁言Act=20
+func handleChatMute(c *Client, m Message) error {
+	message := m.(*ChatMuteMsg)
+	field := message.Uid
+	if field == "" {
+		field = muteAll
+	}
+	muteKey := fmt.Sprintf(chatMuteKeyFormat, c.unitId, c.unitInfo.SceneId)
+	var err error
+	if message.Mute {
+		_, err = c.redconn.Do("HSET", muteKey, field, time.Now().Unix())
+	} else {
+		_, err = c.redconn.Do("HDEL", muteKey, field)
+	}
+	if err != nil {
+		return storageError(err)
+	}
+	log.Printf("[%s] Mute %s: %t\n", c.id, field, message.Mute)
+	message.CreatedAt = time.Now().Unix()
+	return nil
+}
+
+// 客户端是否被禁言，from为消息的发送者，本地中控转发时为本地终端id。
+// 老师不受禁言限制，本地终端的身份取自本地中控的注册消息
+func (c *Client) chatMuted(from string) (bool, error) {
+	fields := []interface{}{muteAll, c.id}
+	if c.isLocalControl() && from != "" && from != c.id {
+		if item, ok := c.localUsers.Get(from); ok && item.Idt == "1" {
+			return false, nil
+		}
+		fields = append(fields, from)
+	} else if c.role() == RoleTeacher {
+		return false, nil
+	}
+	muteKey := fmt.Sprintf(chatMuteKeyFormat, c.unitId, c.unitInfo.SceneId)
+	values, err := redis.Strings(c.redconn.Do("HMGET", append([]interface{}{muteKey}, fields...)...))
+	if err != nil {
+		return false, err
+	}
+	for _, v := range values {
+		if v != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 查询场景的禁言状态
+func chatMutes(redconn redis.Conn, unitId string, sceneId int) (all bool, users []string, err error) {
+	fields, err := redis.Strings(redconn.Do("HKEYS", fmt.Sprintf(chatMuteKeyFormat, unitId, sceneId)))
+	if err != nil {
+		return false, nil, err
+	}
+	users = make([]string, 0, len(fields))
+	for _, field := range fields {
+		if field == muteAll {
+			all = true
+		} else {
+			users = append(users, field)
+		}
+	}
+	sort.Strings(users)
+	return all, users, nil
+}
+
+// 定向消息的可见者(已排序)：发送者及发送时的接收者。
+// 开启集群时，其它节点的终端取自在线记录(见presence.go)
+func (c *Client) chatVisible(to string) []string {
+	expr, err := ParseTo(to)
+	if err != nil {
+		return []string{c.id}
+	}
+	set := map[string]struct{}{c.id: {}}
+	if room := c.hub.room(c.unitId); room != nil {
+		room.mutex.RLock()
+		for id := range expr.Eval(room.cache) {
+			set[id] = struct{}{}
+		}
+		room.mutex.RUnlock()
+	}
+	if c.hub.cluster != nil {
+		if list, err := c.hub.onlines(c.unitId); err == nil {
+			for id := range expr.Eval(presenceCache(list)) {
+				set[id] = struct{}{}
+			}
+		}
+	}
+	visible := make([]string, 0, len(set))
+	for id := range set {
+		visible = append(visible, id)
+	}
+	sort.Strings(visible)
+	return visible
+}
+
+// 根据在线记录生成单元缓存，分类规则同Room.add
+func presenceCache(list []*Presence) *UnitCache {
+	uc := NewUnitCache()
+	for _, p := range list {
+		uc.All[p.Id] = struct{}{}
+		if p.Identity == 1 {
+			uc.Tea[p.Id] = struct{}{}
+		} else if p.Identity == 2 {
+			uc.Stu[p.Id] = struct{}{}
+		}
+		if p.Type == "device" || p.Type == "local_control" {
+			uc.Dev[p.Id] = struct{}{}
+		}
+		if p.Type == "local_control" {
+			uc.Nds[p.Id] = struct{}{}
+		}
+		if p.Classroom != "" {
+			if uc.Cls[p.Classroom] == nil {
+				uc.Cls[p.Classroom] = make(map[string]struct{})
+			}
+			uc.Cls[p.Classroom][p.Id] = struct{}{}
+		}
+	}
+	return uc
+}
+
+// 去重，保持顺序
+func uniqueIds(ids []string) []string {
+	if len(ids) == 0 {
+		return nil
+	}
+	seen := make(map[string]struct{}, len(ids))
+	list := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok || id == "" {
+			continue
+		}
+		seen[id] = struct{}{}
+		list = append(list, id)
+	}
+	return list
+}
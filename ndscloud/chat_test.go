@@ -0,0 +1,191 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// 错误码，err不是*Error时为0
+func errCode(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return 0
+}
+
+// 单元u1中的客户端，identity为1时是老师
+func newChatClient(r *fakeRedis, id string, identity int) *Client {
+	c := newTestClient(nil, "u1", id, nil, 0)
+	c.identity = identity
+	c.redconn = r
+	c.localUsers = NewLocalUserSet()
+	return c
+}
+
+func TestChatRecordVisibleTo(t *testing.T) {
+	public := &chatRecord{}
+	if !public.visibleTo("s1") || !public.visibleTo("") {
+		t.Errorf("public record should be visible to everyone")
+	}
+	directed := &chatRecord{Visible: []string{"s1", "t1"}}
+	for id, want := range map[string]bool{"s1": true, "t1": true, "s2": false, "": false} {
+		if got := directed.visibleTo(id); got != want {
+			t.Errorf("visibleTo(%q) = %t, want %t", id, got, want)
+		}
+	}
+}
+
+func TestHandleChatText(t *testing.T) {
+	hub := NewHub()
+	r := newFakeRedis()
+	t1 := newChatClient(r, "t1", 1)
+	s1 := newChatClient(r, "s1", 2)
+	s2 := newChatClient(r, "s2", 2)
+	for _, c := range []*Client{t1, s1, s2} {
+		c.hub = hub
+	}
+	hub.add(t1, s1, s2)
+	defer hub.removebyunitid("u1")
+
+	cases := []struct {
+		to      string
+		at      []string
+		visible string // 以逗号分隔，为空时所有人可见
+		code    int
+	}{
+		{to: "", at: []string{"s2"}},
+		// 发送给所有终端的消息不限定可见者
+		{to: "A", at: []string{"s2"}},
+		{to: "A|T"},
+		{to: "A@t1"},
+		{to: "T", visible: "s1,t1"},
+		{to: "s2", at: []string{"s2"}, visible: "s1,s2"},
+		{to: "T", at: []string{"s2"}, code: ErrCodeBadMention},
+	}
+	for _, c := range cases {
+		message := &ChatTextMsg{Act: "15", From: "s1", To: c.to, At: c.at, ChatId: 9}
+		err := handleChatText(s1, message)
+		if errCode(err) != c.code {
+			t.Errorf("to %q: got error %v, want code %d", c.to, err, c.code)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := strings.Join(message.visible, ","); got != c.visible {
+			t.Errorf("to %q: visible %q, want %q", c.to, got, c.visible)
+		}
+		if message.ChatId != 0 {
+			t.Errorf("to %q: chat_id not reset", c.to)
+		}
+	}
+}
+
+func TestHandleChatRecall(t *testing.T) {
+	r := newFakeRedis()
+	chatKey := fmt.Sprintf(chatKeyFormat, "u1", 1)
+	r.rpush(chatKey, &chatRecord{ChatTextMsg: ChatTextMsg{Act: "15", ChatId: 1, From: "s1", Msg: map[string]interface{}{"c": "hi"}}, Sender: "s1"})
+	r.rpush(chatKey, &chatRecord{ChatTextMsg: ChatTextMsg{Act: "15", ChatId: 2, From: "s1", To: "t1", At: []string{"t1"}}, Sender: "s1", Visible: []string{"s1", "t1"}})
+	r.rpush(chatKey, &chatRecord{ChatTextMsg: ChatTextMsg{Act: "15", ChatId: 3, From: "s2"}, Sender: "s2"})
+	s1 := newChatClient(r, "s1", 2)
+	s2 := newChatClient(r, "s2", 2)
+	t1 := newChatClient(r, "t1", 1)
+
+	recall := func(c *Client, chatId int64) (*ChatRecallMsg, error) {
+		message := &ChatRecallMsg{Act: "19", ChatId: chatId, From: c.id}
+		return message, handleChatRecall(c, message)
+	}
+	record := func(chatId int64) *chatRecord {
+		record := new(chatRecord)
+		json.Unmarshal([]byte(r.lists[chatKey][chatId-1]), record)
+		return record
+	}
+
+	// 只有发送者或老师可以撤回
+	if _, err := recall(s2, 1); errCode(err) != ErrCodeUnauthorizedAct {
+		t.Errorf("other student: got %v, want unauthorized", err)
+	}
+	if record(1).Recalled {
+		t.Errorf("recalled by other student")
+	}
+	if _, err := recall(s1, 1); err != nil {
+		t.Fatalf("sender: got %v", err)
+	}
+	if rec := record(1); !rec.Recalled || rec.RecalledBy != "s1" || rec.Msg != nil || rec.Sender != "s1" {
+		t.Errorf("tombstone: got %+v", rec)
+	}
+	if _, err := recall(s1, 1); errCode(err) != ErrCodeNotFound {
+		t.Errorf("recall twice: got %v, want not found", err)
+	}
+	if _, err := recall(s1, 9); errCode(err) != ErrCodeNotFound {
+		t.Errorf("missing chat: got %v, want not found", err)
+	}
+	if _, err := recall(s1, 0); errCode(err) != ErrCodeMissingField {
+		t.Errorf("chat_id 0: got %v, want missing field", err)
+	}
+
+	// 老师撤回定向消息，撤回消息发送给原消息的可见者；并发修改时重试
+	r.conflicts = 2
+	message, err := recall(t1, 2)
+	if err != nil {
+		t.Fatalf("teacher: got %v", err)
+	}
+	if message.To != "s1,t1" {
+		t.Errorf("recall to %q, want s1,t1", message.To)
+	}
+	if rec := record(2); !rec.Recalled || rec.RecalledBy != "t1" || rec.At != nil || strings.Join(rec.Visible, ",") != "s1,t1" {
+		t.Errorf("tombstone: got %+v", rec)
+	}
+
+	r.conflicts = chatRecallRetries
+	if _, err := recall(s2, 3); errCode(err) != ErrCodeConflict {
+		t.Errorf("too many conflicts: got %v, want conflict", err)
+	}
+	if record(3).Recalled {
+		t.Errorf("recalled despite conflicts")
+	}
+}
+
+func TestChatMuted(t *testing.T) {
+	r := newFakeRedis()
+	muteKey := fmt.Sprintf(chatMuteKeyFormat, "u1", 1)
+	s1 := newChatClient(r, "s1", 2)
+	t1 := newChatClient(r, "t1", 1)
+	nds := newChatClient(r, "n1", 0)
+	nds.info = &DeviceInfo{ClientId: "n1", Dt: "1"}
+	nds.localUsers.Add(LocalUsrRegItem{Uid: "lt1", Idt: "1"})
+	nds.localUsers.Add(LocalUsrRegItem{Uid: "ls1", Idt: "2"})
+
+	cases := []struct {
+		mute []string
+		c    *Client
+		from string
+		want bool
+	}{
+		{mute: nil, c: s1, from: "s1", want: false},
+		{mute: []string{"s1"}, c: s1, from: "s1", want: true},
+		{mute: []string{"s2"}, c: s1, from: "s1", want: false},
+		// 禁言全体时老师及本地中控转发的本地老师不受限制
+		{mute: []string{muteAll}, c: s1, from: "s1", want: true},
+		{mute: []string{muteAll}, c: t1, from: "t1", want: false},
+		{mute: []string{"t1"}, c: t1, from: "t1", want: false},
+		{mute: []string{muteAll}, c: nds, from: "lt1", want: false},
+		{mute: []string{muteAll}, c: nds, from: "ls1", want: true},
+		{mute: []string{muteAll}, c: nds, from: "unknown", want: true},
+		{mute: []string{"ls1"}, c: nds, from: "ls1", want: true},
+		{mute: []string{"ls1"}, c: nds, from: "lt1", want: false},
+		{mute: []string{"n1"}, c: nds, from: "ls1", want: true},
+	}
+	for _, c := range cases {
+		r.hashes[muteKey] = make(map[string]string)
+		for _, field := range c.mute {
+			r.hashes[muteKey][field] = "1"
+		}
+		got, err := c.c.chatMuted(c.from)
+		if err != nil || got != c.want {
+			t.Errorf("mute %v, %s from %s: got %t, %v, want %t", c.mute, c.c.id, c.from, got, err, c.want)
+		}
+	}
+}
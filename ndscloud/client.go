@@ -1,12 +1,17 @@
 package ndscloud
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/darling-kefan/xj/config"
 	"github.com/darling-kefan/xj/helper"
 	"github.com/gomodule/redigo/redis"
 	"github.com/gorilla/websocket"
@@ -24,6 +29,35 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 512
+
+	// Default size of Client.outbound and Client.outbound_pms.
+	outboundSize = 256
+
+	// Close code sent to a client disconnected by the overflow policy.
+	closeSlowConsumer = 4008
+
+	// Close code sent to a client kicked by an administrator.
+	closeKicked = 4009
+
+	// Close code sent to a client disconnected for exceeding rate limits.
+	closeRateLimited = 4010
+)
+
+// Overflow policies applied when a client's outbound buffer is full.
+const (
+	// Discard the oldest queued message to make room.
+	OverflowDropOldest = "drop_oldest"
+	// Discard the message being sent.
+	OverflowDropNewest = "drop_newest"
+	// Disconnect the client with Cc.OverflowCloseCode.
+	OverflowDisconnect = "disconnect"
+)
+
+var (
+	// 因缓冲区满被丢弃的消息数
+	droppedMessages = expvar.NewInt("ndscloud.dropped_messages")
+	// 因缓冲区满被断开的客户端数
+	shedClients = expvar.NewInt("ndscloud.shed_clients")
 )
 
 // Client is a middleman between the websocket connection and the server.
@@ -40,6 +74,9 @@ type Client struct {
 	// Buffered channel of outbound messages.
 	outbound chan []byte
 
+	// Buffered channel of outbound penmanship binary frames.
+	outbound_pms chan []byte
+
 	// Stop channel is used to terminate registration countdown goroutine.
 	stopreg chan struct{}
 
@@ -68,11 +105,55 @@ type Client struct {
 	// 读写锁(由于其它接口线程会读取LocalUsers和LocalDevices而产生竞争条件，因此需要加锁)
 	mtx sync.RWMutex
 
+	// outbound是否已关闭，投递消息持有读锁，关闭时持有写锁，避免向已关闭的channel发送
+	outMtx    sync.RWMutex
+	outClosed bool
+
 	// 本地中控上报的用户
 	localUsers *LocalUserSet
 
 	// 本地中控上报的设备
 	localDevices *LocalDeviceSet
+
+	// 正在拉取的笔迹(由Act=13/14维护)，"A"表示拉取单元内所有笔迹
+	pullInks map[string]struct{}
+
+	// 发送缓冲区满时的策略
+	overflow string
+
+	// 因缓冲区满被丢弃的消息数(atomic)
+	dropped int64
+
+	// 断开连接时发送的关闭码及原因，0表示正常关闭
+	closeCode   int
+	closeReason string
+
+	// 已被断开，不再接收消息
+	shed bool
+
+	// 断线重连时客户端收到的最后一条消息编号
+	resumeSeq int64
+
+	// 补发错过的消息中，暂不接收实时消息
+	resuming bool
+
+	// 主动下线(Act=9/11)，断线后不再推送下线消息
+	left bool
+
+	// 宽限期内重连的本地中控，断线前上报的本地终端，id => 是否为用户
+	carried map[string]bool
+
+	// 处理中消息的rid，回复确认或错误时带回，回复后清空(仅readPump访问)
+	rid string
+
+	// 按act的发送速率限制(见ratelimit.go)
+	limits rateLimiter
+
+	// 注册完成，处理完注册消息后推送同步消息(仅readPump访问)
+	syncPending bool
+
+	// 各终端最后一帧笔迹的时间，用于划分笔迹段(仅readPump访问)
+	inkAt map[string]int64
 }
 
 func NewClient(token string, unitId string, redconn redis.Conn, conn *websocket.Conn, hub *Hub) (client *Client, err error) {
@@ -80,7 +161,7 @@ func NewClient(token string, unitId string, redconn redis.Conn, conn *websocket.
 	systoken, err := helper.AccessToken(redconn, "client_credentials", nil)
 
 	// 获取单元信息
-	unitInfo, err := getUnitInfo(systoken, unitId)
+	unitInfo, err := getUnitInfo(context.Background(), systoken, unitId)
 	if err != nil {
 		return nil, err
 	}
@@ -97,7 +178,7 @@ func NewClient(token string, unitId string, redconn redis.Conn, conn *websocket.
 	if userInfo, ok := tokenInfo.(*UserInfo); ok {
 		id = userInfo.Uid
 		// 获取用户在课程单元中的身份
-		unitidt, err := getUnitidt(systoken, unitId, userInfo.Uid)
+		unitidt, err := getUnitidt(context.Background(), systoken, unitId, userInfo.Uid)
 		if err != nil {
 			return nil, err
 		}
@@ -125,11 +206,21 @@ func NewClient(token string, unitId string, redconn redis.Conn, conn *websocket.
 	}
 	unitInfo.SceneId = sceneId
 
+	size := config.Config.Cc.Outbound
+	if size <= 0 {
+		size = outboundSize
+	}
+	overflow := config.Config.Cc.Overflow
+	if overflow == "" {
+		overflow = OverflowDisconnect
+	}
+
 	client = &Client{
 		hub:          hub,
 		conn:         conn,
 		redconn:      redconn,
-		outbound:     make(chan []byte, 256),
+		outbound:     make(chan []byte, size),
+		outbound_pms: make(chan []byte, size),
 		stopreg:      make(chan struct{}),
 		id:           id,
 		identity:     identity,
@@ -138,6 +229,9 @@ func NewClient(token string, unitId string, redconn redis.Conn, conn *websocket.
 		unitInfo:     unitInfo,
 		localUsers:   NewLocalUserSet(),
 		localDevices: NewLocalDeviceSet(),
+		pullInks:     make(map[string]struct{}),
+		overflow:     overflow,
+		inkAt:        make(map[string]int64),
 	}
 	// 重置错误变量
 	err = nil
@@ -166,37 +260,91 @@ func (c *Client) isLocalControl() bool {
 	return false
 }
 
+// 终端所在教室：设备取其配置的教室，否则取单元的第一个教室
+func (c *Client) classroom() string {
+	if deviceInfo, ok := c.info.(*DeviceInfo); ok && deviceInfo.Config.Device.ClassroomId != "" {
+		return deviceInfo.Config.Device.ClassroomId
+	}
+	if len(c.unitInfo.Classroom) > 0 {
+		return c.unitInfo.Classroom[0].Id
+	}
+	return ""
+}
+
+// 供包外注册的ActSpec访问客户端信息
+func (c *Client) Id() string {
+	return c.id
+}
+
+func (c *Client) UnitId() string {
+	return c.unitId
+}
+
+func (c *Client) SceneId() int {
+	return c.unitInfo.SceneId
+}
+
+func (c *Client) Identity() int {
+	return c.identity
+}
+
 // Forced login. Force other terminals to disconnect.
 func (c *Client) forceLogin() {
-	// Judging whether to login
-	if c.hub.exists(c) {
-		// 1. 获取登录中的客户端，并向该客户端发送强制退出消息
-		loginClient := c.hub.get(c.id)
-		loginClient.conn.SetWriteDeadline(time.Now().Add(writeWait))
-		loginClient.conn.WriteMessage(websocket.TextMessage, []byte(`{"errcode":1, "errmsg":"forced logout"}`))
+	// 1. 获取登录中的客户端(可能已同时断开)，并向该客户端发送强制退出消息
+	if loginClient := c.hub.get(c.id); loginClient != nil {
+		loginClient.send(errorReply("", "", ErrForcedLogout))
 
 		// 2. 退出登录中的客户端
 		c.hub.unregister <- loginClient
 	}
-	// 3. 新客户端登录
+	// 3. 断开其它节点上登录中的客户端
+	if c.hub.cluster != nil {
+		c.hub.cluster.kick(c.id)
+	}
+	// 4. 新客户端登录
 	c.hub.register <- c
 }
 
-// Logout
-func (c *Client) logout(msg string) {
-	// 1. 关闭websocket连接，redis连接
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	c.conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"errcode": 1, "errmsg": "%s"}`, msg)))
+// Logout. act为引起下线的消息，可为空
+func (c *Client) logout(act string, err error) {
+	// 1. 发送下线原因，关闭redis连接(websocket连接由writePump关闭)
+	c.send(errorReply(act, c.rid, err))
+	c.rid = ""
 	c.redconn.Close()
 
 	// 2. 通知枢纽注销客户端
 	c.hub.unregister <- c
 }
 
-// notice to the client
-func (c *Client) notice(msg string) {
-	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	c.conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"errcode": 1, "errmsg": "%s"}`, msg)))
+// notice to the client. act为引起错误的消息，可为空
+func (c *Client) notice(act string, err error) {
+	c.send(errorReply(act, c.rid, err))
+	c.rid = ""
+}
+
+// 确认消息已处理完毕，未携带rid或已回复错误时不确认
+func (c *Client) ack(act string) {
+	if c.rid != "" {
+		c.send(errorReply(act, c.rid, nil))
+		c.rid = ""
+	}
+}
+
+// 发送消息：经由发送缓冲区，与转发的消息有序且只有writePump写连接；
+// 缓冲区满时按overflow策略处理，已关闭时丢弃
+func (c *Client) send(msg []byte) {
+	c.deliver(c.outbound, msg)
+}
+
+// 关闭发送缓冲区，writePump发送关闭帧后断开连接，可重复调用
+func (c *Client) closeOutbound() {
+	c.outMtx.Lock()
+	defer c.outMtx.Unlock()
+
+	if !c.outClosed {
+		c.outClosed = true
+		close(c.outbound)
+	}
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -219,7 +367,14 @@ func (c *Client) readPump() {
 	// https://godoc.org/github.com/gorilla/websocket#Conn.SetReadDeadline
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	// TODO wireshark抓包分析ping/pong
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		// 续期在线记录
+		if c.isRegistered && c == c.hub.get(c.id) {
+			c.hub.setOnline(c)
+		}
+		return nil
+	})
 	for {
 		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
@@ -235,7 +390,8 @@ func (c *Client) readPump() {
 			// Message processor
 			c.process(message)
 		case websocket.BinaryMessage:
-
+			// Penmanship processor
+			c.processPms(message)
 		case websocket.CloseMessage:
 
 		case websocket.PingMessage:
@@ -266,11 +422,17 @@ func (c *Client) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				if code, reason := c.getClose(); code != 0 {
+					c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+				} else {
+					c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				}
 				return
 			}
 			c.conn.WriteMessage(websocket.TextMessage, message)
-
+		case message := <-c.outbound_pms:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.BinaryMessage, message)
 			// @TODO 由于可能存在多个goroutine同时向终端发送消息，因此此处不适合批量发送消息
 			//// Send messages to terminals in batches
 			//w, err := c.conn.NextWriter(websocket.TextMessage)
@@ -298,6 +460,178 @@ func (c *Client) writePump() {
 	}
 }
 
+// 开始拉取笔迹，get为逗号分隔的用户id，为空或"A"表示拉取所有笔迹
+func (c *Client) pullInk(get string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if get == "" {
+		get = "A"
+	}
+	for _, uid := range strings.Split(get, ",") {
+		if uid != "" {
+			c.pullInks[uid] = struct{}{}
+		}
+	}
+}
+
+// 停止拉取笔迹，get为空表示停止拉取所有笔迹
+func (c *Client) endPullInk(get string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if get == "" {
+		c.pullInks = make(map[string]struct{})
+		return
+	}
+	for _, uid := range strings.Split(get, ",") {
+		delete(c.pullInks, uid)
+	}
+}
+
+// 判断客户端是否在拉取该用户的笔迹
+func (c *Client) isPullingInk(uid string) bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	if _, ok := c.pullInks["A"]; ok {
+		return true
+	}
+	_, ok := c.pullInks[uid]
+	return ok
+}
+
+// 向客户端投递消息，缓冲区满时按overflow策略处理，已关闭时丢弃
+func (c *Client) deliver(ch chan []byte, msg []byte) {
+	c.outMtx.RLock()
+	defer c.outMtx.RUnlock()
+	if c.outClosed {
+		return
+	}
+
+	c.mtx.RLock()
+	shed := c.shed
+	c.mtx.RUnlock()
+	if shed {
+		return
+	}
+
+	select {
+	case ch <- msg:
+		return
+	default:
+	}
+
+	switch c.overflow {
+	case OverflowDropNewest:
+		c.drop(1)
+	case OverflowDropOldest:
+		for {
+			select {
+			case ch <- msg:
+				return
+			default:
+			}
+			select {
+			case <-ch:
+				c.drop(1)
+			default:
+			}
+		}
+	default:
+		c.disconnect()
+	}
+}
+
+// 记录丢弃的消息
+func (c *Client) drop(n int64) {
+	total := atomic.AddInt64(&c.dropped, n)
+	droppedMessages.Add(n)
+	// 每丢弃100条消息记录一次日志
+	if total%100 == 1 {
+		log.Printf("[%s] Outbound full, policy: %s, dropped: %d, depth: %d\n", c.id, c.overflow, total, c.queueDepth())
+	}
+}
+
+// 断开消费过慢的客户端
+func (c *Client) disconnect() {
+	c.mtx.Lock()
+	if c.shed {
+		c.mtx.Unlock()
+		return
+	}
+	c.shed = true
+	c.closeCode = config.Config.Cc.OverflowCloseCode
+	if c.closeCode == 0 {
+		c.closeCode = closeSlowConsumer
+	}
+	c.closeReason = "slow consumer"
+	c.mtx.Unlock()
+
+	shedClients.Add(1)
+	log.Printf("[%s] Outbound full, shed client of unit %s, depth: %d\n", c.id, c.unitId, c.queueDepth())
+	// 调用者持有Room的读锁，需异步注销
+	go func() {
+		c.hub.unregister <- c
+	}()
+}
+
+// 设置关闭码及原因，由writePump在关闭连接时发送
+func (c *Client) setClose(code int, reason string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.closeCode = code
+	c.closeReason = reason
+}
+
+func (c *Client) getClose() (int, string) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.closeCode, c.closeReason
+}
+
+// 发送缓冲区中待发送的消息数
+func (c *Client) queueDepth() int {
+	return len(c.outbound) + len(c.outbound_pms)
+}
+
+// 因缓冲区满被丢弃的消息数
+func (c *Client) droppedCount() int64 {
+	return atomic.LoadInt64(&c.dropped)
+}
+
+// 设置断线重连前收到的最后一条消息编号，注册后补发错过的消息
+func (c *Client) setResume(lastSeq int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.resumeSeq = lastSeq
+	c.resuming = lastSeq > 0
+}
+
+func (c *Client) isResuming() bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.resuming
+}
+
+// 补发结束，seq为已补发到的消息编号
+func (c *Client) endResume(seq int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.resuming = false
+	if seq > c.resumeSeq {
+		c.resumeSeq = seq
+	}
+}
+
+// 判断是否跳过实时消息：补发中，或该消息已补发
+func (c *Client) skipLive(seq int64) bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.resuming || (seq != 0 && seq <= c.resumeSeq)
+}
+
 // 记录日志
 func (c *Client) log(msg string) {
 	log.Printf("[%s] %s\n", c.id, msg)
@@ -334,6 +668,13 @@ func (ls *LocalUserSet) Remove(uid string) {
 	delete(ls.users, uid)
 }
 
+func (ls *LocalUserSet) Get(uid string) (LocalUsrRegItem, bool) {
+	ls.RLock()
+	defer ls.RUnlock()
+	item, ok := ls.users[uid]
+	return item, ok
+}
+
 func (ls *LocalUserSet) List() []LocalUsrRegItem {
 	ls.RLock()
 	defer ls.RUnlock()
@@ -375,6 +716,13 @@ func (ls *LocalDeviceSet) Remove(did string) {
 	delete(ls.devices, did)
 }
 
+func (ld *LocalDeviceSet) Get(did string) (LocalDevRegItem, bool) {
+	ld.RLock()
+	defer ld.RUnlock()
+	item, ok := ld.devices[did]
+	return item, ok
+}
+
 func (ld *LocalDeviceSet) List() []LocalDevRegItem {
 	ld.RLock()
 	defer ld.RUnlock()
@@ -0,0 +1,56 @@
+package ndscloud
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForceLogin(t *testing.T) {
+	hub := NewHub()
+	registered := make(chan *Client, 2)
+	unregistered := make(chan *Client, 2)
+	go func() {
+		for {
+			select {
+			case c := <-hub.register:
+				registered <- c
+			case c := <-hub.unregister:
+				unregistered <- c
+			}
+		}
+	}()
+
+	// 没有登录中的客户端(或已同时断开)
+	c := newTestClient(hub, "u1", "s1", nil, 0)
+	c.forceLogin()
+	if got := <-registered; got != c {
+		t.Fatalf("registered another client")
+	}
+	select {
+	case <-unregistered:
+		t.Fatalf("unregistered without a logged-in client")
+	default:
+	}
+
+	// 登录中的客户端收到强制退出消息并被注销
+	old := &Client{hub: hub, id: "s1", unitId: "u1", unitInfo: &UnitInfo{SceneId: 1}, outbound: make(chan []byte, outboundSize), overflow: OverflowDropOldest}
+	hub.add(old)
+	defer hub.removebyunitid("u1")
+	c = newTestClient(hub, "u1", "s1", nil, 0)
+	c.forceLogin()
+	if got := <-unregistered; got != old {
+		t.Errorf("unregistered another client")
+	}
+	if got := <-registered; got != c {
+		t.Errorf("registered another client")
+	}
+	select {
+	case b := <-old.outbound:
+		if !strings.Contains(string(b), ErrForcedLogout.Msg) {
+			t.Errorf("got %s, want forced logout", b)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("no forced logout message")
+	}
+}
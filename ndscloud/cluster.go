@@ -0,0 +1,216 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+	"github.com/gomodule/redigo/redis"
+)
+
+// 多实例集群：各节点通过Redis pub/sub交换消息。
+// > msg:    单元消息，远端节点按本地客户端重新计算接收者并转发
+// > pms:    笔迹流，远端节点转发给本地拉取该笔迹的客户端
+// > kick:   强制登录，远端节点断开同一id的客户端
+// > endunit: 单元结束，远端节点通知并断开该单元的客户端
+// > roster: 查询单元在线终端，各节点将本地终端写入应答队列
+
+const (
+	clusterKindMsg     = "msg"
+	clusterKindPms     = "pms"
+	clusterKindKick    = "kick"
+	clusterKindRoster  = "roster"
+	clusterKindEndUnit = "endunit"
+
+	// 等待各节点应答roster请求的超时时间(秒)
+	clusterReplyTimeout = 1
+)
+
+// 集群消息
+type clusterMsg struct {
+	Node   string          `json:"node"`
+	Kind   string          `json:"kind"`
+	Unit   string          `json:"unit,omitempty"`
+	Sender string          `json:"sender,omitempty"`
+	Id     string          `json:"id,omitempty"`
+	Reply  string          `json:"reply,omitempty"`
+	Seq    int64           `json:"seq,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Pms    []byte          `json:"pms,omitempty"`
+}
+
+type cluster struct {
+	hub *Hub
+
+	// 当前节点名称
+	node string
+
+	// 待发布的集群消息
+	outbox chan *clusterMsg
+
+	// roster请求序号
+	seq int64
+}
+
+func newCluster(hub *Hub) *cluster {
+	node := config.Config.Cc.Node
+	if node == "" {
+		hostname, _ := os.Hostname()
+		node = hostname + ":" + strconv.Itoa(os.Getpid())
+	}
+	return &cluster{
+		hub:    hub,
+		node:   node,
+		outbox: make(chan *clusterMsg, 1024),
+	}
+}
+
+func (cl *cluster) run() {
+	go cl.publishLoop()
+	go cl.subscribeLoop()
+}
+
+// 发布单元消息，body为消息的json编码(不含seq)
+func (cl *cluster) publish(message Message, body []byte, seq int64) {
+	route := message.GetRoute()
+	cl.outbox <- &clusterMsg{Node: cl.node, Kind: clusterKindMsg, Unit: route.Unit, Sender: route.Sender, Seq: seq, Body: body}
+}
+
+// 发布笔迹流
+func (cl *cluster) publishPms(message *PmsMsg) {
+	cl.outbox <- &clusterMsg{Node: cl.node, Kind: clusterKindPms, Unit: message.Unit, Sender: message.Sender, Id: message.Uid, Pms: message.Raw}
+}
+
+// 通知其它节点断开该id的客户端
+func (cl *cluster) kick(id string) {
+	cl.outbox <- &clusterMsg{Node: cl.node, Kind: clusterKindKick, Id: id}
+}
+
+// 通知其它节点结束单元
+func (cl *cluster) endUnit(unitId string) {
+	cl.outbox <- &clusterMsg{Node: cl.node, Kind: clusterKindEndUnit, Unit: unitId}
+}
+
+func (cl *cluster) publishLoop() {
+	for cm := range cl.outbox {
+		b, err := json.Marshal(cm)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		conn := cl.hub.pool.Get()
+		if _, err := conn.Do("PUBLISH", clusterChannel, b); err != nil {
+			log.Printf("[cluster] Failed to publish %s, error: %s\n", cm.Kind, err)
+		}
+		conn.Close()
+	}
+}
+
+// 订阅集群频道，断线后重连
+func (cl *cluster) subscribeLoop() {
+	for {
+		if err := cl.subscribe(); err != nil {
+			log.Printf("[cluster] %s, resubscribe after 1s\n", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (cl *cluster) subscribe() error {
+	conn, err := connectRedis()
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	if err := psc.Subscribe(clusterChannel); err != nil {
+		return err
+	}
+	log.Printf("[cluster] Node %s subscribed %s\n", cl.node, clusterChannel)
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			var cm clusterMsg
+			if err := json.Unmarshal(v.Data, &cm); err != nil {
+				log.Println(err)
+				continue
+			}
+			cl.dispatch(&cm)
+		case error:
+			return v
+		}
+	}
+}
+
+func (cl *cluster) dispatch(cm *clusterMsg) {
+	// roster请求当前节点也需要应答
+	if cm.Kind == clusterKindRoster {
+		go cl.replyRoster(cm)
+		return
+	}
+	if cm.Node == cl.node {
+		return
+	}
+	cl.hub.handleRemote(cm)
+}
+
+// 将本地单元终端写入应答队列
+func (cl *cluster) replyRoster(cm *clusterMsg) {
+	b, err := json.Marshal(rosterOf(cl.hub.listbyunitid(cm.Unit)))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	conn := cl.hub.pool.Get()
+	defer conn.Close()
+	conn.Send("RPUSH", cm.Reply, b)
+	conn.Send("EXPIRE", cm.Reply, clusterReplyTimeout*10)
+	if err := conn.Flush(); err != nil {
+		log.Println(err)
+	}
+}
+
+// 查询所有节点上的单元终端
+func (cl *cluster) roster(unitId string) ([]interface{}, error) {
+	reply := fmt.Sprintf(clusterReplyKeyFormat, cl.node, atomic.AddInt64(&cl.seq, 1))
+	b, err := json.Marshal(&clusterMsg{Node: cl.node, Kind: clusterKindRoster, Unit: unitId, Reply: reply})
+	if err != nil {
+		return nil, err
+	}
+
+	conn := cl.hub.pool.Get()
+	defer conn.Close()
+	defer conn.Do("DEL", reply)
+
+	// PUBLISH返回收到消息的订阅者个数，即需要等待的应答个数
+	nodes, err := redis.Int(conn.Do("PUBLISH", clusterChannel, b))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]interface{}, 0)
+	for i := 0; i < nodes; i++ {
+		res, err := redis.ByteSlices(conn.Do("BLPOP", reply, clusterReplyTimeout))
+		if err == redis.ErrNil {
+			log.Printf("[cluster] Roster of %s: %d/%d nodes replied\n", unitId, i, nodes)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(res[1], &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			list = append(list, item)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,154 @@
+package ndscloud
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+	"github.com/darling-kefan/xj/filter"
+)
+
+// 敏感词过滤：词表文件由Cc.FilterWords配置，收到SIGHUP时重新加载。
+// 过滤聊天消息(Act=15)，Cc.FilterOrdinary开启时同时过滤普通消息(Act=6)msg中的字符串；老师的消息不过滤。
+// 过滤方式(Cc.FilterMode)：
+// > mask   敏感词逐字替换为*后发送(默认)
+// > reject 拒绝发送，回复ErrCodeSensitive
+// > flag   原样发送，消息处理成功后向单元内的老师发送标记消息(Act=21)
+
+const (
+	filterMask   = "mask"
+	filterReject = "reject"
+	filterFlag   = "flag"
+)
+
+var wordFilter *filter.Filter
+
+// 加载词表，由Hub.Run调用
+func loadContentFilter() {
+	path := config.Config.Cc.FilterWords
+	if path == "" {
+		return
+	}
+	f, err := filter.Load(path)
+	if err != nil {
+		log.Fatalf("Failed to load filter words %s: %s\n", path, err)
+	}
+	switch config.Config.Cc.FilterMode {
+	case "", filterMask, filterReject, filterFlag:
+	default:
+		log.Fatalf("Unknown filter mode %s\n", config.Config.Cc.FilterMode)
+	}
+	wordFilter = f
+	log.Printf("[filter] Loaded %d words from %s\n", f.Matcher().Len(), path)
+	go watchFilterReload(f, path)
+}
+
+func watchFilterReload(f *filter.Filter, path string) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := f.Reload(); err != nil {
+			log.Printf("[filter] Failed to reload %s: %s\n", path, err)
+			continue
+		}
+		log.Printf("[filter] Reloaded %d words from %s\n", f.Matcher().Len(), path)
+	}
+}
+
+// 可过滤敏感词的消息
+type Filterable interface {
+	// 对消息中的每段文本调用fn，并替换为其返回值
+	FilterText(fn func(string) string)
+}
+
+func (m *ChatTextMsg) FilterText(fn func(string) string) {
+	if msg, ok := m.Msg.(map[string]interface{}); ok {
+		if text, ok := msg["c"].(string); ok {
+			msg["c"] = fn(text)
+		}
+	}
+}
+
+func (m *OrdinaryMsg) FilterText(fn func(string) string) {
+	m.Msg = filterStrings(m.Msg, fn)
+}
+
+// 递归替换json值中的字符串
+func filterStrings(v interface{}, fn func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return fn(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = filterStrings(item, fn)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = filterStrings(item, fn)
+		}
+	}
+	return v
+}
+
+// 过滤消息中的敏感词，在Validate之后、Handle之前执行，返回匹配到的敏感词
+func filterContent(c *Client, m Message) ([]string, error) {
+	if wordFilter == nil || c.role() == RoleTeacher {
+		return nil, nil
+	}
+	fm, ok := m.(Filterable)
+	if !ok {
+		return nil, nil
+	}
+	if _, ok := m.(*OrdinaryMsg); ok && !config.Config.Cc.FilterOrdinary {
+		return nil, nil
+	}
+
+	matcher := wordFilter.Matcher()
+	mode := config.Config.Cc.FilterMode
+	found := make(map[string]struct{})
+	fm.FilterText(func(text string) string {
+		matches := matcher.Match(text)
+		for _, match := range matches {
+			found[match.Word] = struct{}{}
+		}
+		if len(matches) > 0 && (mode == "" || mode == filterMask) {
+			return matcher.Mask(text, '*')
+		}
+		return text
+	})
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	words := make([]string, 0, len(found))
+	for word := range found {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	log.Printf("[%s] Sensitive words %v in act %s\n", c.id, words, specOf(m).Act)
+
+	if mode == filterReject {
+		return words, NewError(ErrCodeSensitive, "message contains sensitive words")
+	}
+	return words, nil
+}
+
+// flag方式下向单元内的老师发送标记消息，在消息处理及持久化成功后调用
+func (c *Client) flagContent(m Message, words []string) {
+	if len(words) == 0 || config.Config.Cc.FilterMode != filterFlag {
+		return
+	}
+	c.hub.dispatch(&ContentFlagMsg{
+		Act:       "21",
+		Type:      specOf(m).Act,
+		From:      c.id,
+		Words:     words,
+		Msg:       m,
+		CreatedAt: time.Now().Unix(),
+		Route:     Route{Unit: c.unitId},
+	})
+}
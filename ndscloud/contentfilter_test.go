@@ -0,0 +1,118 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+	"github.com/darling-kefan/xj/filter"
+)
+
+// 使用词表words及过滤方式mode，返回恢复函数
+func setTestFilter(t *testing.T, mode string, words ...string) func() {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "words.txt")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(words, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := filter.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFilter, oldMode := wordFilter, config.Config.Cc.FilterMode
+	wordFilter, config.Config.Cc.FilterMode = f, mode
+	return func() {
+		wordFilter, config.Config.Cc.FilterMode = oldFilter, oldMode
+		os.RemoveAll(dir)
+	}
+}
+
+// 读取客户端发送缓冲区中的消息直到act，超时返回nil
+func waitAct(c *Client, act string, timeout time.Duration) map[string]interface{} {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case b := <-c.outbound:
+			var m map[string]interface{}
+			if json.Unmarshal(b, &m) == nil && m["act"] == act {
+				return m
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+func TestFilterContentModes(t *testing.T) {
+	s1 := newChatClient(newFakeRedis(), "s1", 2)
+	t1 := newChatClient(newFakeRedis(), "t1", 1)
+	chat := func(text string) *ChatTextMsg {
+		return &ChatTextMsg{Act: "15", From: "s1", Msg: map[string]interface{}{"c": text}}
+	}
+	text := func(m *ChatTextMsg) string {
+		return m.Msg.(map[string]interface{})["c"].(string)
+	}
+
+	defer setTestFilter(t, filterMask, "笨蛋")()
+	m := chat("你是笨蛋")
+	if words, err := filterContent(s1, m); err != nil || strings.Join(words, ",") != "笨蛋" || text(m) != "你是**" {
+		t.Errorf("mask: got %v, %v, %q", words, err, text(m))
+	}
+	// 老师的消息不过滤
+	m = chat("你是笨蛋")
+	if words, err := filterContent(t1, m); err != nil || words != nil || text(m) != "你是笨蛋" {
+		t.Errorf("teacher: got %v, %v, %q", words, err, text(m))
+	}
+
+	config.Config.Cc.FilterMode = filterReject
+	if _, err := filterContent(s1, chat("笨蛋")); errCode(err) != ErrCodeSensitive {
+		t.Errorf("reject: got %v", err)
+	}
+
+	config.Config.Cc.FilterMode = filterFlag
+	m = chat("你是笨蛋")
+	if words, err := filterContent(s1, m); err != nil || len(words) != 1 || text(m) != "你是笨蛋" {
+		t.Errorf("flag: got %v, %v, %q", words, err, text(m))
+	}
+}
+
+// flag方式下只有成功处理的消息才向老师发送标记消息
+func TestContentFlagAfterPersist(t *testing.T) {
+	defer setTestFilter(t, filterFlag, "笨蛋")()
+
+	hub := NewHub()
+	r := newFakeRedis()
+	s1 := newChatClient(r, "s1", 2)
+	s1.hub = hub
+	teacher := &Client{hub: hub, id: "t1", identity: 1, unitId: "u1", unitInfo: &UnitInfo{SceneId: 1}, outbound: make(chan []byte, outboundSize), overflow: OverflowDropOldest}
+	hub.add(s1, teacher)
+	defer hub.removebyunitid("u1")
+
+	// @非接收者，Handle拒绝
+	s1.process([]byte(`{"act":"15","from":"s1","to":"t1","at":["s2"],"msg":{"c":"笨蛋"}}`))
+	if m := waitAct(teacher, "21", 100*time.Millisecond); m != nil {
+		t.Errorf("flagged a rejected message: %v", m)
+	}
+	if n := len(r.lists[fmt.Sprintf(chatKeyFormat, "u1", 1)]); n != 0 {
+		t.Fatalf("rejected message stored")
+	}
+
+	s1.process([]byte(`{"act":"15","from":"s1","msg":{"c":"笨蛋"}}`))
+	m := waitAct(teacher, "21", time.Second)
+	if m == nil {
+		t.Fatalf("no flag message")
+	}
+	msg, _ := m["msg"].(map[string]interface{})
+	if m["from"] != "s1" || m["type"] != "15" || msg["chat_id"] != float64(1) {
+		t.Errorf("got flag %v", m)
+	}
+}
@@ -0,0 +1,145 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/websocket"
+)
+
+// 结束单元：
+// 1. 记录单元场景结束时间，自增场景id(Redis脚本保证同一场景只结束一次)
+// 2. 通知各节点：向单元所有客户端广播结束消息(Act=12, stat=2)，并发送关闭帧断开连接
+//
+// 触发方式：管理接口 POST /v2/admin/units/:unit_id/end，
+// Redis信号 PUBLISH nc:unit:end "{unitId}:{sceneId}"，或客户端发送Act=12(stat=2)。
+
+// 场景已结束或不存在
+var ErrSceneEnded = &Error{Code: ErrCodeSceneEnded, Msg: "scene already ended"}
+
+// 结束单元场景
+// KEYS[1]: scene id key, KEYS[2]: scene key
+// ARGV[1]: scene id, ARGV[2]: unit id, ARGV[3]: end time
+var endUnitScript = redis.NewScript(2, `
+local cur = redis.call('GET', KEYS[1])
+if not cur or tonumber(cur) ~= tonumber(ARGV[1]) then
+	return 0
+end
+local info = redis.call('GET', KEYS[2])
+local scene
+if info then
+	scene = cjson.decode(info)
+else
+	scene = {unit_id = ARGV[2], scene_id = tonumber(ARGV[1])}
+end
+scene['end_time'] = tonumber(ARGV[3])
+redis.call('SET', KEYS[2], cjson.encode(scene))
+redis.call('INCR', KEYS[1])
+return 1
+`)
+
+// 结束单元的场景，sceneId为0时结束当前场景
+func (h *Hub) EndUnit(unitId string, sceneId int) error {
+	conn := h.pool.Get()
+	defer conn.Close()
+
+	sceneIdKey := fmt.Sprintf(sceneIdKeyFormat, unitId)
+	if sceneId == 0 {
+		cur, err := redis.Int(conn.Do("GET", sceneIdKey))
+		if err == redis.ErrNil {
+			return ErrSceneEnded
+		}
+		if err != nil {
+			return err
+		}
+		sceneId = cur
+	}
+
+	sceneKey := fmt.Sprintf(sceneKeyFormat, unitId, sceneId)
+	ended, err := redis.Int(endUnitScript.Do(conn, sceneIdKey, sceneKey, sceneId, unitId, time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+	if ended == 0 {
+		return ErrSceneEnded
+	}
+	log.Printf("[endunit] Unit %s scene %d ended\n", unitId, sceneId)
+
+	if h.cluster != nil {
+		h.cluster.endUnit(unitId)
+	}
+	h.endunit <- unitId
+	return nil
+}
+
+// 向本节点单元内所有客户端广播结束消息，并断开连接，由Hub.Run调用
+func (h *Hub) endUnitLocal(unitId string) {
+	room := h.room(unitId)
+	if room == nil {
+		return
+	}
+
+	message := &UnitControlMsg{
+		Act:   "12",
+		From:  "0",
+		Msg:   map[string]interface{}{"stat": "2"},
+		Route: Route{Unit: unitId},
+	}
+	body, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, client := range room.list() {
+		client.setClose(websocket.CloseNormalClosure, "unit ended")
+	}
+	// 结束消息不编号，先于关闭帧写入各客户端的发送缓冲区
+	room.broadcast(message, body, 0)
+	h.removebyunitid(unitId)
+}
+
+// 订阅结束单元信号，断线后重连
+func (h *Hub) watchEndUnit() {
+	for {
+		if err := h.subscribeEndUnit(); err != nil {
+			log.Printf("[endunit] %s, resubscribe after 1s\n", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (h *Hub) subscribeEndUnit() error {
+	conn, err := connectRedis()
+	if err != nil {
+		return err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	if err := psc.Subscribe(endUnitChannel); err != nil {
+		return err
+	}
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			// 开启集群时各节点都会收到信号，由Redis脚本保证只有一个节点结束场景
+			parts := strings.SplitN(string(v.Data), ":", 2)
+			sceneId := 0
+			if len(parts) == 2 {
+				sceneId, _ = strconv.Atoi(parts[1])
+			}
+			go func(unitId string, sceneId int) {
+				if err := h.EndUnit(unitId, sceneId); err != nil && err != ErrSceneEnded {
+					log.Printf("[endunit] Failed to end unit %s, error: %s\n", unitId, err)
+				}
+			}(parts[0], sceneId)
+		case error:
+			return v
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// 下发给客户端的错误码，客户端按errcode区分错误，errmsg仅供调试
+const (
+	// 未分类错误(兼容旧版本)
+	ErrCodeUnknown = 1
+
+	// 消息格式错误 1xxx
+	ErrCodeBadFormat    = 1001 // 不是合法的json
+	ErrCodeUnknownAct   = 1002 // 未知的act
+	ErrCodeMissingField = 1003 // 缺少字段
+	ErrCodeMissingTo    = 1004 // 缺少to字段
+	ErrCodeBadTo        = 1005 // to字段语法错误
+	ErrCodeTooLong      = 1006 // 消息过长
+	ErrCodeBadInk       = 1007 // 笔迹帧格式错误
+	ErrCodeBadMention   = 1008 // @的终端不是消息的接收者
+	ErrCodeNotFound     = 1009 // 引用的消息不存在
+	ErrCodeSensitive    = 1010 // 含敏感词
+	ErrCodeConflict     = 1011 // 模块状态版本冲突
+	ErrCodeBadParam     = 1012 // 连接参数错误
+
+	// 权限错误 2xxx
+	ErrCodeUnauthorizedAct  = 2001 // 无权发送该act
+	ErrCodeNotRegistered    = 2002 // 未注册
+	ErrCodeBadRegistration  = 2003 // 注册消息与身份不匹配
+	ErrCodeForcedLogout     = 2004 // 同一id在其它终端登录
+	ErrCodeKicked           = 2005 // 被管理员断开
+	ErrCodeSceneEnded       = 2006 // 单元场景已结束
+	ErrCodeClientTerminated = 2007 // 客户端主动下线
+	ErrCodeMuted            = 2008 // 已被禁言
+	ErrCodeInvalidToken     = 2009 // 令牌无效
+
+	// 服务端错误 3xxx
+	ErrCodeStorage = 3001 // 存储失败
+	ErrCodeBackend = 3002 // 后端接口失败
+
+	// 限制 4xxx
+	ErrCodeRateLimited = 4001 // 发送过于频繁
+)
+
+// 带错误码的错误，Validate/Handle/Persist返回该类错误时按其错误码回复客户端
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func NewError(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// 存储失败
+func storageError(err error) *Error {
+	return NewError(ErrCodeStorage, "storage failure: %s", err)
+}
+
+var (
+	ErrForcedLogout = &Error{Code: ErrCodeForcedLogout, Msg: "forced logout"}
+	ErrKicked       = &Error{Code: ErrCodeKicked, Msg: "kicked by administrator"}
+	ErrTerminated   = &Error{Code: ErrCodeClientTerminated, Msg: "terminate client"}
+)
+
+// 错误回复及确认，act、rid取自引起回复的消息
+type ErrorReply struct {
+	Errcode int    `json:"errcode"`
+	Errmsg  string `json:"errmsg"`
+	Act     string `json:"act,omitempty"`
+	Rid     string `json:"rid,omitempty"`
+}
+
+// 生成错误回复，err为nil时为确认
+func errorReply(act, rid string, err error) []byte {
+	if err == nil {
+		b, _ := json.Marshal(&ErrorReply{Errcode: 0, Errmsg: "OK", Act: act, Rid: rid})
+		return b
+	}
+	reply := &ErrorReply{Errcode: ErrCodeUnknown, Errmsg: err.Error(), Act: act, Rid: rid}
+	switch e := err.(type) {
+	case *Error:
+		reply.Errcode = e.Code
+	case *ToSyntaxError:
+		reply.Errcode = ErrCodeBadTo
+	}
+	if err == ErrInvalidToken {
+		reply.Errcode = ErrCodeInvalidToken
+	}
+	b, _ := json.Marshal(reply)
+	return b
+}
@@ -32,64 +32,49 @@ func outputJson(c *gin.Context, errcode int, errmsg string, data interface{}) {
 	c.JSON(http.StatusOK, jsonData)
 }
 
-// TODO 如何支持JSONP???
-func ServeUsers(hub *Hub, c *gin.Context) {
-	// 判断课程是否公开/免费
-	unitId := c.Param("unit_id")
-	ok, err := isPublicAndPremium(unitId)
-	if err != nil {
-		outputJson(c, 1, err.Error(), nil)
-		return
-	}
-	// 验证token
-	if !ok {
-		token := c.Query("token")
-		if token == "" {
-			outputJson(c, 1, "missing param token", nil)
-			return
-		}
-		if _, err := getTokenInfo(token); err != nil {
-			outputJson(c, 1, err.Error(), nil)
-			return
-		}
-	}
+// 单元在线终端
+type rosterUser struct {
+	Type          int         `json:"type"`
+	Id            string      `json:"id"`
+	Name          string      `json:"name"`
+	VideoInteract int         `json:"videointeract"`
+	HandWrite     int         `json:"handwrite"`
+	OnlineAt      int64       `json:"online_at"`
+	Classroom     string      `json:"classroom"`
+	UserInfo      interface{} `json:"userinfo"`
+}
 
-	type User struct {
-		Type          int         `json:"type"`
-		Id            string      `json:"id"`
-		Name          string      `json:"name"`
-		VideoInteract int         `json:"videointeract"`
-		HandWrite     int         `json:"handwrite"`
-		OnlineAt      int64       `json:"online_at"`
-		Classroom     string      `json:"classroom"`
-		UserInfo      interface{} `json:"userinfo"`
-	}
-	type Device struct {
-		Type          int    `json:"type"`
-		Id            string `json:"id"`
-		Name          string `json:"name"`
-		VideoInteract int    `json:"videointeract"`
-		HandWrite     int    `json:"handwrite"`
-		OnlineAt      int64  `json:"online_at"`
-		Classroom     string `json:"classroom"`
-	}
+type rosterDevice struct {
+	Type          int    `json:"type"`
+	Id            string `json:"id"`
+	Name          string `json:"name"`
+	VideoInteract int    `json:"videointeract"`
+	HandWrite     int    `json:"handwrite"`
+	OnlineAt      int64  `json:"online_at"`
+	Classroom     string `json:"classroom"`
+}
 
+// 生成终端列表，本地中控上报的用户和设备一并列出
+func rosterOf(list []*Client) []interface{} {
 	clients := make([]interface{}, 0)
-	for _, client := range hub.list() {
+	for _, client := range list {
+		// 终端所在教室
+		classroom := client.classroom()
+
 		switch {
 		case client.isLocalControl():
 			deviceDetail := client.info.(*DeviceInfo)
 			dt, _ := strconv.Atoi(deviceDetail.Dt)
 			vi, _ := strconv.Atoi(deviceDetail.Vi)
 			hw, _ := strconv.Atoi(deviceDetail.Hw)
-			device := &Device{
+			device := &rosterDevice{
 				Type:          dt,
 				Id:            client.id,
 				Name:          deviceDetail.ClientId,
 				VideoInteract: vi,
 				HandWrite:     hw,
 				OnlineAt:      client.registeredAt,
-				Classroom:     client.unitInfo.Classroom[0].Id,
+				Classroom:     classroom,
 			}
 			clients = append(clients, device)
 
@@ -103,14 +88,14 @@ func ServeUsers(hub *Hub, c *gin.Context) {
 				userInfo["sex"] = sex
 				userInfo["avatar"] = ""
 				userInfo["identity"] = idt
-				localUser := &User{
+				localUser := &rosterUser{
 					Type:          0,
 					Id:            userItem.Uid,
 					Name:          userItem.Nm,
 					VideoInteract: vi,
 					HandWrite:     hw,
 					OnlineAt:      userItem.RegisteredAt,
-					Classroom:     client.unitInfo.Classroom[0].Id,
+					Classroom:     classroom,
 					UserInfo:      userInfo,
 				}
 				clients = append(clients, localUser)
@@ -121,14 +106,14 @@ func ServeUsers(hub *Hub, c *gin.Context) {
 				dt, _ := strconv.Atoi(deviceItem.Dt)
 				vi, _ := strconv.Atoi(deviceItem.Vi)
 				hw, _ := strconv.Atoi(deviceItem.Hw)
-				localDevice := &Device{
+				localDevice := &rosterDevice{
 					Type:          dt,
 					Id:            deviceItem.Did,
 					Name:          deviceItem.Nm,
 					VideoInteract: vi,
 					HandWrite:     hw,
 					OnlineAt:      deviceItem.RegisteredAt,
-					Classroom:     client.unitInfo.Classroom[0].Id,
+					Classroom:     classroom,
 				}
 				clients = append(clients, localDevice)
 			}
@@ -140,14 +125,14 @@ func ServeUsers(hub *Hub, c *gin.Context) {
 			userAttr["identity"] = client.identity
 			vi, _ := strconv.Atoi(userDetail.Vi)
 			hw, _ := strconv.Atoi(userDetail.Hw)
-			user := &User{
+			user := &rosterUser{
 				Type:          0,
 				Id:            client.id,
 				Name:          userDetail.Name,
 				VideoInteract: vi,
 				HandWrite:     hw,
 				OnlineAt:      client.registeredAt,
-				Classroom:     client.unitInfo.Classroom[0].Id,
+				Classroom:     classroom,
 				UserInfo:      userAttr,
 			}
 			clients = append(clients, user)
@@ -156,18 +141,48 @@ func ServeUsers(hub *Hub, c *gin.Context) {
 			dt, _ := strconv.Atoi(deviceDetail.Dt)
 			vi, _ := strconv.Atoi(deviceDetail.Vi)
 			hw, _ := strconv.Atoi(deviceDetail.Hw)
-			device := &Device{
+			device := &rosterDevice{
 				Type:          dt,
 				Id:            client.id,
 				Name:          deviceDetail.ClientId,
 				VideoInteract: vi,
 				HandWrite:     hw,
 				OnlineAt:      client.registeredAt,
-				Classroom:     client.unitInfo.Classroom[0].Id,
+				Classroom:     classroom,
 			}
 			clients = append(clients, device)
 		}
 	}
+	return clients
+}
+
+// TODO 如何支持JSONP???
+func ServeUsers(hub *Hub, c *gin.Context) {
+	// 判断课程是否公开/免费
+	unitId := c.Param("unit_id")
+	ok, err := isPublicAndPremium(c.Request.Context(), unitId)
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	// 验证token
+	if !ok {
+		token := c.Query("token")
+		if token == "" {
+			outputJson(c, 1, "missing param token", nil)
+			return
+		}
+		if _, err := getTokenInfo(token); err != nil {
+			outputJson(c, 1, err.Error(), nil)
+			return
+		}
+	}
+
+	clients, err := hub.roster(unitId)
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
 
 	data := make(map[string]interface{})
 	data["total"] = len(clients)
@@ -177,7 +192,52 @@ func ServeUsers(hub *Hub, c *gin.Context) {
 
 // 获取所有单元场景
 func ServeScenes(c *gin.Context) {
-	c.String(http.StatusOK, "Hello scenes")
+	// 判断课程是否公开/免费
+	unitId := c.Param("unit_id")
+	ok, err := isPublicAndPremium(c.Request.Context(), unitId)
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	// 验证token
+	if !ok {
+		token := c.Query("token")
+		if token == "" {
+			outputJson(c, 1, "missing param token", nil)
+			return
+		}
+		if _, err := getTokenInfo(token); err != nil {
+			outputJson(c, 1, err.Error(), nil)
+			return
+		}
+	}
+
+	// 创建redis连接
+	redconn, err := connectRedis()
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	defer redconn.Close()
+
+	scenes, err := unitScenes(redconn, unitId)
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+
+	// 排序
+	if c.Query("sort") == "desc" {
+		for i := len(scenes)/2 - 1; i >= 0; i-- {
+			opp := len(scenes) - 1 - i
+			scenes[i], scenes[opp] = scenes[opp], scenes[i]
+		}
+	}
+
+	outputJson(c, 0, "OK", gin.H{
+		"total": len(scenes),
+		"list":  scenes,
+	})
 }
 
 // 获取单元最新模块状态
@@ -185,7 +245,7 @@ func ServeModStatus(c *gin.Context) {
 	// 判断课程是否公开/免费
 	unitId := c.Param("unit_id")
 	moduleId := c.Param("module_id")
-	ok, err := isPublicAndPremium(unitId)
+	ok, err := isPublicAndPremium(c.Request.Context(), unitId)
 	if err != nil {
 		outputJson(c, 1, err.Error(), nil)
 		return
@@ -243,6 +303,7 @@ func ServeModStatus(c *gin.Context) {
 			"id":         "1", // TODO 写死
 			"mod":        mod,
 			"msg":        modstat.Msg,
+			"version":    modstat.Version,
 			"updated_at": time.Unix(modstat.UpdatedAt, 0).Format("2006-01-02 15:04:05"),
 		}
 
@@ -265,7 +326,7 @@ func ServeModStatus(c *gin.Context) {
 func ServeModList(c *gin.Context) {
 	// 判断课程是否公开/免费
 	unitId := c.Param("unit_id")
-	ok, err := isPublicAndPremium(unitId)
+	ok, err := isPublicAndPremium(c.Request.Context(), unitId)
 	if err != nil {
 		outputJson(c, 1, err.Error(), nil)
 		return
@@ -283,12 +344,42 @@ func ServeModList(c *gin.Context) {
 		}
 	}
 
+	// 查询条件
+	query := modListQuery{
+		Mod:    c.Query("mod"),
+		From:   c.Query("from"),
+		Cursor: c.Query("cursor"),
+		Limit:  20,
+	}
+	if c.Query("start_time") != "" {
+		query.StartTime, err = strconv.ParseInt(c.Query("start_time"), 10, 64)
+		if err != nil {
+			outputJson(c, 1, err.Error(), nil)
+			return
+		}
+	}
+	if c.Query("end_time") != "" {
+		query.EndTime, err = strconv.ParseInt(c.Query("end_time"), 10, 64)
+		if err != nil {
+			outputJson(c, 1, err.Error(), nil)
+			return
+		}
+	}
+	if c.Query("limit") != "" {
+		query.Limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || query.Limit <= 0 || query.Limit > 1000 {
+			outputJson(c, 1, "limit must be between 1 and 1000", nil)
+			return
+		}
+	}
+
 	// 创建redis连接
 	redconn, err := connectRedis()
 	if err != nil {
 		outputJson(c, 1, err.Error(), nil)
 		return
 	}
+	defer redconn.Close()
 
 	sceneId := 0
 	if c.Param("scene_id") != "" {
@@ -304,8 +395,9 @@ func ServeModList(c *gin.Context) {
 		sceneId, err = redis.Int(redconn.Do("GET", sceneIdKey))
 		if err == redis.ErrNil {
 			outputJson(c, 0, "OK", gin.H{
-				"total": 0,
-				"list":  make([]interface{}, 0),
+				"total":       0,
+				"list":        make([]interface{}, 0),
+				"next_cursor": "",
 			})
 			return
 		}
@@ -315,75 +407,16 @@ func ServeModList(c *gin.Context) {
 		}
 	}
 
-	// 检索该单元场景下的所有模块
-	iter := 0
-	match := fmt.Sprintf("nc:ins:mod:his:%s:%d:*", unitId, sceneId)
-	modkeys := make([]string, 0)
-	for {
-		res, err := redis.Values(redconn.Do("SCAN", iter, "MATCH", match, "COUNT", 1))
-		if err != nil {
-			outputJson(c, 1, err.Error(), nil)
-			return
-		}
-		for _, v := range res[1].([]interface{}) {
-			modkeys = append(modkeys, string(v.([]byte)))
-		}
-		iter, _ = strconv.Atoi(string(res[0].([]byte)))
-		if iter == 0 {
-			break
-		}
-	}
-	log.Printf("%#v\n", modkeys)
-
-	statmods := make(map[string][]map[string]interface{})
-	modtimes := make([]map[string]interface{}, 0)
-	for _, modkey := range modkeys {
-		res, err := redis.ByteSlices(redconn.Do("lrange", modkey, 0, -1))
-		if err != nil {
-			outputJson(c, 1, err.Error(), nil)
-			return
-		}
-
-		modinses := make([]map[string]interface{}, 0)
-		for _, v := range res {
-			var modins ModStatusMsg
-			_ = json.Unmarshal(v, &modins)
-			modItem := map[string]interface{}{
-				"id":         "1",
-				"mod":        modins.Mod,
-				"msg":        modins.Msg,
-				"created_at": modins.CreatedAt,
-			}
-			modinses = append(modinses, modItem)
-		}
-		statmods[modkey] = modinses
-		// 用于排序模块
-		modtimes = append(modtimes, map[string]interface{}{
-			"key":        modkey,
-			"created_at": modinses[0]["created_at"].(int64),
-		})
-	}
-
-	// 按时间升序排列模块
-	sort.Slice(modtimes, func(i, j int) bool {
-		return modtimes[i]["created_at"].(int64) < modtimes[j]["created_at"].(int64)
-	})
-
-	i := 1
-	instructions := make([]map[string]interface{}, 0)
-	for _, v := range modtimes {
-		modkey := v["key"].(string)
-		for _, item := range statmods[modkey] {
-			item["id"] = strconv.Itoa(i)
-			item["created_at"] = time.Unix(item["created_at"].(int64), 0).Format("2006-01-02 15:04:05")
-			instructions = append(instructions, item)
-			i = i + 1
-		}
+	instructions, nextCursor, err := modInstructions(redconn, unitId, sceneId, query)
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
 	}
 
 	outputJson(c, 0, "OK", gin.H{
-		"total": len(instructions),
-		"list":  instructions,
+		"total":       len(instructions),
+		"list":        instructions,
+		"next_cursor": nextCursor,
 	})
 }
 
@@ -391,22 +424,23 @@ func ServeModList(c *gin.Context) {
 func ServeChats(c *gin.Context) {
 	// 判断课程是否公开/免费
 	unitId := c.Param("unit_id")
-	ok, err := isPublicAndPremium(unitId)
+	ok, err := isPublicAndPremium(c.Request.Context(), unitId)
 	if err != nil {
 		outputJson(c, 1, err.Error(), nil)
 		return
 	}
-	// 验证token
-	if !ok {
-		token := c.Query("token")
-		if token == "" {
-			outputJson(c, 1, "missing param token", nil)
-			return
-		}
-		if _, err := getTokenInfo(token); err != nil {
+	// 验证token，定向消息只返回给其可见者
+	viewer := ""
+	if token := c.Query("token"); token != "" {
+		info, err := getTokenInfo(token)
+		if err != nil && !ok {
 			outputJson(c, 1, err.Error(), nil)
 			return
 		}
+		viewer = tokenId(info)
+	} else if !ok {
+		outputJson(c, 1, "missing param token", nil)
+		return
 	}
 
 	chatId := 0
@@ -462,7 +496,7 @@ func ServeChats(c *gin.Context) {
 			outputJson(c, 1, err.Error(), nil)
 			return
 		}
-		unitInfo, err := getUnitInfo(token, unitId)
+		unitInfo, err := getUnitInfo(c.Request.Context(), token, unitId)
 		if err != nil {
 			outputJson(c, 1, err.Error(), nil)
 			return
@@ -472,6 +506,14 @@ func ServeChats(c *gin.Context) {
 		}
 	}
 
+	// 禁言状态
+	mutedAll, mutedUsers, err := chatMutes(redconn, unitId, sceneId)
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	mute := gin.H{"all": mutedAll, "users": mutedUsers}
+
 	chatKey := fmt.Sprintf(chatKeyFormat, unitId, sceneId)
 	// 获取列表长度
 	count, err := redis.Int(redconn.Do("LLEN", chatKey))
@@ -482,6 +524,7 @@ func ServeChats(c *gin.Context) {
 		outputJson(c, 0, "OK", gin.H{
 			"total": 0,
 			"list":  make([]interface{}, 0),
+			"mute":  mute,
 		})
 		return
 	}
@@ -508,16 +551,31 @@ func ServeChats(c *gin.Context) {
 		if length > 0 {
 			for k, v := range res {
 				msgId := ep - length + k + 2
-				var chatText ChatTextMsg
-				if err := json.Unmarshal(v, &chatText); err != nil {
+				var record chatRecord
+				if err := json.Unmarshal(v, &record); err != nil {
 					outputJson(c, 1, err.Error(), nil)
 					return
 				}
+				if !record.visibleTo(viewer) {
+					continue
+				}
 				nva := map[string]interface{}{
 					"chat_id":    msgId,
-					"from":       chatText.From,
-					"msg":        chatText.Msg,
-					"created_at": time.Unix(chatText.CreatedAt, 0).Format("2006-01-02 15:04:05"),
+					"from":       record.From,
+					"msg":        record.Msg,
+					"created_at": time.Unix(record.CreatedAt, 0).Format("2006-01-02 15:04:05"),
+				}
+				if record.To != "" {
+					nva["to"] = record.To
+				}
+				if len(record.At) > 0 {
+					nva["at"] = record.At
+				}
+				// 已撤回的消息
+				if record.Recalled {
+					nva["recalled"] = true
+					nva["recalled_by"] = record.RecalledBy
+					nva["recalled_at"] = time.Unix(record.RecalledAt, 0).Format("2006-01-02 15:04:05")
 				}
 				chatmsgs = append(chatmsgs, nva)
 			}
@@ -535,6 +593,108 @@ func ServeChats(c *gin.Context) {
 	outputJson(c, 0, "OK", gin.H{
 		"total": len(chatmsgs),
 		"list":  chatmsgs,
+		"mute":  mute,
+	})
+}
+
+// 课程时间线，返回cursor之后的limit个事件，total为场景的事件总数。
+// format=ndjson时逐行输出事件(默认不限条数)，最后一行为{"type":"end","next_cursor":...}
+func ServeTimeline(c *gin.Context) {
+	// 判断课程是否公开/免费
+	unitId := c.Param("unit_id")
+	ok, err := isPublicAndPremium(c.Request.Context(), unitId)
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	// 验证token，定向聊天消息只返回给其可见者
+	viewer := ""
+	if token := c.Query("token"); token != "" {
+		info, err := getTokenInfo(token)
+		if err != nil && !ok {
+			outputJson(c, 1, err.Error(), nil)
+			return
+		}
+		viewer = tokenId(info)
+	} else if !ok {
+		outputJson(c, 1, "missing param token", nil)
+		return
+	}
+
+	sceneId, err := strconv.Atoi(c.Param("scene_id"))
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	cursor, err := parseTimelineCursor(c.Query("cursor"))
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	ndjson := c.Query("format") == "ndjson"
+	limit := 100
+	if ndjson {
+		limit = 0
+	}
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 0 || limit > 1000 {
+			outputJson(c, 1, "limit must be between 0 and 1000", nil)
+			return
+		}
+	}
+
+	// 创建redis连接
+	redconn, err := connectRedis()
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	defer redconn.Close()
+
+	// 逐个写入读取到的事件，最后一行为下一页的游标
+	if ndjson {
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		enc := json.NewEncoder(c.Writer)
+		n := 0
+		nextCursor, err := sceneTimeline(redconn, unitId, sceneId, viewer, cursor, limit, func(event *timelineEvent) error {
+			if err := enc.Encode(event); err != nil {
+				return err
+			}
+			if n++; n%100 == 0 {
+				c.Writer.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[timeline] Failed to stream %s:%d, error: %s\n", unitId, sceneId, err)
+			enc.Encode(gin.H{"type": "error", "msg": err.Error()})
+		} else {
+			enc.Encode(gin.H{"type": "end", "next_cursor": nextCursor})
+		}
+		c.Writer.Flush()
+		return
+	}
+
+	events := make([]*timelineEvent, 0)
+	nextCursor, err := sceneTimeline(redconn, unitId, sceneId, viewer, cursor, limit, func(event *timelineEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	total, err := sceneTimelineTotal(redconn, unitId, sceneId)
+	if err != nil {
+		outputJson(c, 1, err.Error(), nil)
+		return
+	}
+	outputJson(c, 0, "OK", gin.H{
+		"total":       total,
+		"list":        events,
+		"next_cursor": nextCursor,
 	})
 }
 
@@ -543,7 +703,14 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
-//func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
+// 拒绝websocket连接：回复错误后关闭连接，此时writePump尚未启动，可直接写连接
+func rejectWs(conn *websocket.Conn, err error) {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.WriteMessage(websocket.TextMessage, errorReply("", "", err))
+	conn.Close()
+}
+
+// func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
 func ServeWs(hub *Hub, c *gin.Context) {
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -554,22 +721,19 @@ func ServeWs(hub *Hub, c *gin.Context) {
 
 	token := c.Query("token")
 	if token == "" {
-		conn.WriteMessage(websocket.TextMessage, []byte("token is empty."))
-		conn.Close()
+		rejectWs(conn, NewError(ErrCodeBadParam, "token is empty."))
 		return
 	}
 
 	unitId := c.Param("unit_id")
 	if unitId == "" {
-		conn.WriteMessage(websocket.TextMessage, []byte("unit_id is empty."))
-		conn.Close()
+		rejectWs(conn, NewError(ErrCodeBadParam, "unit_id is empty."))
 		return
 	}
 
 	redconn, err := connectRedis()
 	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
-		conn.Close()
+		rejectWs(conn, storageError(err))
 		return
 	}
 
@@ -577,12 +741,25 @@ func ServeWs(hub *Hub, c *gin.Context) {
 	client, err := NewClient(token, unitId, redconn, conn, hub)
 	if err != nil {
 		log.Println(err)
-		conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
-		conn.Close()
 		redconn.Close()
+		if err != ErrInvalidToken {
+			err = NewError(ErrCodeBackend, "%s", err)
+		}
+		rejectWs(conn, err)
 		return
 	}
 
+	// Resume after reconnect
+	if c.Query("last_seq") != "" {
+		lastSeq, err := strconv.ParseInt(c.Query("last_seq"), 10, 64)
+		if err != nil {
+			redconn.Close()
+			rejectWs(conn, NewError(ErrCodeBadParam, "last_seq is invalid."))
+			return
+		}
+		client.setResume(lastSeq)
+	}
+
 	// Forced login
 	client.forceLogin()
 
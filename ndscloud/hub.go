@@ -3,134 +3,139 @@ package ndscloud
 import (
 	"encoding/json"
 	"log"
+	"os"
 	"sync"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+	"github.com/gomodule/redigo/redis"
 )
 
-// 基于目前的设计：只有一个goroutine可访问Hub，因此Hub.clients和Hub.unittoids是并发安全的～
+// 基于目前的设计：只有一个goroutine(Hub.Run)修改Hub.clients和Hub.rooms，单元消息由各Room转发～
 // 避免竞争条件的三种方式：
 // > 不要去写变量
 // > 避免多个goroutine访问变量
 // > 允许很多goroutine去访问变量，但是在同一个时刻最多只有一个goroutine在访问，使用使用互斥锁等方式。
 //
-// 基于需求，Hub.clients, Hub.unitotids也提供于其它接口使用，因此对其操作应该加锁。
+// 基于需求，Hub.clients, Hub.rooms也提供于其它接口使用，因此对其操作应该加锁。
 
-// Hub maintains the set of active clients and broadcast messages to the
-// clients.
+// Hub is the directory of the active clients. It routes clients and
+// messages to the room of their unit.
 type Hub struct {
 	// Registered clients. ID to Client mapping.
 	clients map[string]*Client
 
-	// UnitId to IDs mapping
-	clientSet map[string]*UnitCache
+	// UnitId to Room mapping
+	rooms map[string]*Room
 
-	// The lock used for Hub.clients and Hub.clientSet
+	// The lock used for Hub.clients, Hub.rooms and Hub.pending
 	mutex sync.RWMutex
 
-	// Inbound messages from the clients. Handle ordinary text messages.
-	inbound chan interface{}
-
-	// Penmanship binary stream.
-	inbound_pms chan []byte
-
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
 
-	// End unit
+	// End unit: notify and disconnect the clients of the unit.
 	endunit chan string
-}
 
-// Classification by identity, and cache it.
-type UnitCache struct {
-	All map[string]struct{} // 定义set类型
-	Tea map[string]struct{}
-	Stu map[string]struct{}
-	Dev map[string]struct{}
-	Nds map[string]struct{}
+	// Tear down unit: disconnect the clients of the unit.
+	teardown chan string
+
+	// Disconnected clients waiting for the offline grace period. ID to offline mapping.
+	pending map[string]*offline
+
+	// Redis connections shared by the rooms and the cluster.
+	pool *redis.Pool
+
+	// Nil if clustering is disabled.
+	cluster *cluster
 }
 
 func NewHub() *Hub {
-	return &Hub{
-		clients:     make(map[string]*Client),
-		clientSet:   make(map[string]*UnitCache),
-		inbound:     make(chan interface{}),
-		inbound_pms: make(chan []byte),
-		register:    make(chan *Client),
-		unregister:  make(chan *Client),
-		endunit:     make(chan string),
+	h := &Hub{
+		clients:    make(map[string]*Client),
+		rooms:      make(map[string]*Room),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		endunit:    make(chan string),
+		teardown:   make(chan string),
+		pending:    make(map[string]*offline),
+		pool:       newRedisPool(),
+	}
+	if config.Config.Cc.Cluster {
+		h.cluster = newCluster(h)
 	}
+	return h
 }
 
-// 新增客户端
+// 新增客户端，单元的第一个客户端注册时创建Room
 func (h *Hub) add(clients ...*Client) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	var found bool
-	var uc *UnitCache
 	for _, client := range clients {
 		h.clients[client.id] = client
 
-		// 获取客户端缓存，存在返回；不存在，则初始化。
-		if uc, found = h.clientSet[client.unitId]; !found {
-			uc = &UnitCache{
-				All: make(map[string]struct{}),
-				Tea: make(map[string]struct{}),
-				Stu: make(map[string]struct{}),
-				Dev: make(map[string]struct{}),
-				Nds: make(map[string]struct{}),
-			}
-			h.clientSet[client.unitId] = uc
-		}
-		// 全体
-		uc.All[client.id] = struct{}{}
-		if client.identity == 1 {
-			// 老师
-			uc.Tea[client.id] = struct{}{}
-		} else if client.identity == 2 {
-			// 学生
-			uc.Stu[client.id] = struct{}{}
+		room, found := h.rooms[client.unitId]
+		if !found {
+			room = newRoom(h, client.unitId)
+			h.rooms[client.unitId] = room
+			go room.run()
+			log.Printf("[room] Start %s\n", client.unitId)
 		}
-		if _, ok := client.info.(*DeviceInfo); ok {
-			// 设备
-			uc.Dev[client.id] = struct{}{}
-		}
-		// 本地中控
-		if client.isLocalControl() {
-			uc.Nds[client.id] = struct{}{}
+		// 断线重连的客户端，补发错过的消息
+		if room.add(client) && client.isResuming() {
+			go func(room *Room, client *Client) {
+				select {
+				case room.resume <- client:
+				case <-room.done:
+				}
+			}(room, client)
 		}
 	}
 }
 
-// 移除客户端
+// 客户端注册完成。持有Hub锁及所在Room的锁写入，admin接口在Room锁内读取
+func (h *Hub) setRegistered(c *Client) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if room, ok := h.rooms[c.unitId]; ok {
+		room.mutex.Lock()
+		defer room.mutex.Unlock()
+	}
+	c.isRegistered = true
+	c.registeredAt = time.Now().UnixNano()
+}
+
+// 移除客户端，单元的最后一个客户端移除时销毁Room
 func (h *Hub) remove(clients ...*Client) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
 	for _, client := range clients {
-		if _, ok := h.clients[client.id]; ok {
-			// close client websocket connection
-			close(client.outbound)
+		if h.clients[client.id] == client {
 			delete(h.clients, client.id)
+			// 宽限期后推送下线消息
+			if client.isRegistered && !client.hasLeft() {
+				h.scheduleOfflineLocked(client)
+			}
+		}
+		if client.isRegistered {
+			go h.setOffline(client)
 		}
 
-		// Clear unit cache
-		if uc, ok := h.clientSet[client.unitId]; ok {
-			delete(uc.All, client.id)
-			if client.identity == 1 {
-				// 老师
-				delete(uc.Tea, client.id)
-			} else if client.identity == 2 {
-				// 学生
-				delete(uc.Stu, client.id)
-			}
-			if _, ok := client.info.(*DeviceInfo); ok {
-				// 设备
-				delete(uc.Dev, client.id)
+		if room, ok := h.rooms[client.unitId]; ok {
+			room.remove(client)
+			if room.empty() {
+				delete(h.rooms, client.unitId)
+				close(room.done)
 			}
 		}
+		// 不在单元内的客户端(如已被新连接替换)同样关闭连接
+		client.closeOutbound()
 	}
 }
 
@@ -139,13 +144,16 @@ func (h *Hub) removebyunitid(unitid string) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	if uc, ok := h.clientSet[unitid]; ok {
-		for id, _ := range uc.All {
-			// close client websocket connection
-			close(h.clients[id].outbound)
-			delete(h.clients, id)
+	if room, ok := h.rooms[unitid]; ok {
+		for _, client := range room.list() {
+			if h.clients[client.id] == client {
+				delete(h.clients, client.id)
+			}
+			go h.setOffline(client)
 		}
-		delete(h.clientSet, unitid)
+		room.clear()
+		delete(h.rooms, unitid)
+		close(room.done)
 	}
 }
 
@@ -169,118 +177,133 @@ func (h *Hub) get(id string) (client *Client) {
 	return nil
 }
 
-// 获取所有客户端
-// TODO 为防止数据竞争，此处返回[]Client而不是[]*Client
-func (h *Hub) list() []Client {
+// 获取所有客户端，读取客户端的可变字段需使用其加锁的方法
+func (h *Hub) list() []*Client {
 	h.mutex.RLock()
 	defer h.mutex.RUnlock()
 
-	list := make([]Client, 0)
+	list := make([]*Client, 0, len(h.clients))
 	for _, item := range h.clients {
-		list = append(list, *item)
+		list = append(list, item)
 	}
 	return list
 }
 
-// 根据消息里的To字段，计算出将消息推送给谁
-func (h *Hub) getrecversbyto(to string, unitid string) (receiverSet map[string]struct{}) {
-	groups, individuals := ParseFieldTo(to)
-	for _, group := range groups {
-		switch group {
-		case "A":
-			receiverSet = h.clientSet[unitid].All
-			return
-		case "T":
-			receiverSet = h.clientSet[unitid].Tea
-		case "S":
-			receiverSet = h.clientSet[unitid].Stu
-		case "D":
-			receiverSet = h.clientSet[unitid].Dev
-		default:
-		}
+// 获取有客户端的单元id
+func (h *Hub) units() []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	list := make([]string, 0, len(h.rooms))
+	for unitid, _ := range h.rooms {
+		list = append(list, unitid)
 	}
-	for _, individual := range individuals {
-		receiverSet[individual] = struct{}{}
+	return list
+}
+
+// 当前节点名称
+func (h *Hub) node() string {
+	if h.cluster != nil {
+		return h.cluster.node
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// 根据单元id获取Room，不存在返回nil
+func (h *Hub) room(unitid string) *Room {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.rooms[unitid]
+}
+
+// 根据单元id获取客户端
+func (h *Hub) listbyunitid(unitid string) []*Client {
+	if room := h.room(unitid); room != nil {
+		return room.list()
 	}
-	return
+	return make([]*Client, 0)
 }
 
-// Calculate message receivers.
-// Determine which clients to send to
-func (h *Hub) msgrecvers(message interface{}) (receivers []string) {
-	// Is it send back to the sender
-	var toSender bool = true
-	// The sender of the message
-	var sender string
-	// The set of receivers
-	var receiverSet map[string]struct{}
-
-	switch msg := message.(type) {
-	case *OrdinaryMsg:
-		sender = msg.Sender
-		toSender = false
-		receiverSet = h.getrecversbyto(msg.To, msg.Unit)
-	case *ModStatusMsg:
-		sender = msg.Sender
-		toSender = false
-		receiverSet = h.getrecversbyto(msg.To, msg.Unit)
-	case *UsrOnlineMsg:
-		sender = msg.Sender
-		toSender = false
-		receiverSet = h.clientSet[msg.Unit].All
-	case *UsrOfflineMsg:
-		sender = msg.Sender
-		toSender = false
-		receiverSet = h.clientSet[msg.Unit].All
-	case *DevOnlineMsg:
-		sender = msg.Sender
-		toSender = false
-		receiverSet = h.clientSet[msg.Unit].All
-	case *DevOfflineMsg:
-		sender = msg.Sender
-		toSender = false
-		receiverSet = h.clientSet[msg.Unit].All
-	case *UnitControlMsg:
-		sender = msg.Sender
-		toSender = false
-		receiverSet = h.clientSet[msg.Unit].All
-	case *PullInkMsg:
-		// 开始接收笔迹消息不转发
-	case *EndPullInkMsg:
-		// 停止接收笔迹消息不转发
-	case *ChatTextMsg:
-		sender = msg.Sender
-		toSender = false
-		receiverSet = h.clientSet[msg.Unit].All
+// 获取单元在线终端，开启集群时汇总所有节点
+func (h *Hub) roster(unitid string) ([]interface{}, error) {
+	if h.cluster != nil {
+		return h.cluster.roster(unitid)
+	}
+	return rosterOf(h.listbyunitid(unitid)), nil
+}
+
+// 将客户端消息投递到所属单元的Room
+func (h *Hub) dispatch(message Message) {
+	unit := message.GetRoute().Unit
+	if room := h.room(unit); room != nil {
+		select {
+		case room.inbound <- message:
+			return
+		case <-room.done:
+		}
 	}
 
-	// Remove sender
-	// TODO ids存的是map的地址，此处执行delete会真正删除hub.clientSet里的内容。
-	//if !toSender {
-	//	delete(ids, sender)
-	//}
-
-	// 分配内存
-	if _, ok := receiverSet[sender]; ok {
-		receivers = make([]string, len(receiverSet)-1)
-	} else {
-		receivers = make([]string, len(receiverSet))
+	// 本节点已没有该单元的客户端(如下线消息)：编号后发布到其它节点
+	body, err := json.Marshal(message)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	seq := h.store(unit, body, message.GetRoute().Sender)
+	if h.cluster != nil {
+		h.cluster.publish(message, body, seq)
 	}
+}
 
-	var i int = 0
-	for id, _ := range receiverSet {
-		// Remove sender
-		if !toSender && sender == id {
-			continue
+// 将笔迹流投递到所属单元的Room
+func (h *Hub) dispatchPms(message *PmsMsg) {
+	if room := h.room(message.Unit); room != nil {
+		select {
+		case room.inbound_pms <- message:
+		case <-room.done:
 		}
-		receivers[i] = id
-		i = i + 1
 	}
+}
 
-	return
+// 处理其它节点发来的消息，本节点没有该单元的客户端时丢弃
+func (h *Hub) handleRemote(cm *clusterMsg) {
+	switch cm.Kind {
+	case clusterKindMsg:
+		if room := h.room(cm.Unit); room != nil {
+			select {
+			case room.remote <- cm:
+			case <-room.done:
+			}
+		}
+	case clusterKindPms:
+		message := &PmsMsg{Uid: cm.Id, Raw: cm.Pms, Sender: cm.Sender, Unit: cm.Unit}
+		if room := h.room(cm.Unit); room != nil {
+			select {
+			case room.remote_pms <- message:
+			case <-room.done:
+			}
+		}
+	case clusterKindEndUnit:
+		h.endunit <- cm.Unit
+	case clusterKindKick:
+		// 其它节点强制登录，断开本节点的客户端
+		if client := h.get(cm.Id); client != nil {
+			client.send(errorReply("", "", ErrForcedLogout))
+			h.unregister <- client
+			log.Printf("[cluster] Kick %s, logged in on node %s\n", cm.Id, cm.Node)
+		}
+	}
 }
 
 func (h *Hub) Run() {
+	if h.cluster != nil {
+		h.cluster.run()
+	}
+	go h.watchEndUnit()
+	checkPermissions()
+	loadContentFilter()
 	for {
 		select {
 		case client := <-h.register:
@@ -288,21 +311,9 @@ func (h *Hub) Run() {
 		case client := <-h.unregister:
 			h.remove(client)
 		case unitid := <-h.endunit:
+			h.endUnitLocal(unitid)
+		case unitid := <-h.teardown:
 			h.removebyunitid(unitid)
-		case message := <-h.inbound:
-			if msg, err := json.Marshal(message); err == nil {
-				receivers := h.msgrecvers(message)
-				log.Printf("Message: %#v, receivers: %v\n", message, receivers)
-				for _, id := range receivers {
-					// 判断to中的个人id是否已经注册到云端
-					if _, ok := h.clients[id]; ok {
-						h.clients[id].outbound <- msg
-						log.Printf("Send %v to %v\n", string(msg), id)
-					}
-				}
-			} else {
-				log.Println(err)
-			}
 		}
 	}
 }
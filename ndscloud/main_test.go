@@ -0,0 +1,17 @@
+package ndscloud
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/darling-kefan/xj/config"
+)
+
+// 测试使用空配置(不连接Redis及后端接口)，并关闭日志
+func TestMain(m *testing.M) {
+	config.Config = new(config.TomlConfig)
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
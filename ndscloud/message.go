@@ -2,13 +2,34 @@ package ndscloud
 
 import (
 	"encoding/json"
-	"errors"
-	"strings"
 )
 
 // 基本消息格式
 type MsgType struct {
 	Act string `json:"act"`
+	// 可选的请求id，消息处理完毕后服务端回复确认或错误时原样带回
+	Rid string `json:"rid,omitempty"`
+}
+
+// 消息路由信息，由服务端填充，不参与json编码
+type Route struct {
+	Sender string `json:"-"`
+	Unit   string `json:"-"`
+}
+
+func (r *Route) GetRoute() *Route {
+	return r
+}
+
+// 所有注册到ActSpec的消息类型需内嵌Route
+type Message interface {
+	GetRoute() *Route
+}
+
+// 按to字段转发(RecvTo)的消息需实现该接口
+type Addressed interface {
+	Message
+	GetTo() string
 }
 
 // 注册消息Act=1
@@ -18,6 +39,7 @@ type RegMsg struct {
 	Os  string `json:"os,omitempty"`
 	Vi  string `json:"vi"`
 	Hw  string `json:"hw"`
+	Route
 }
 
 // 本地用户注册消息Act=2|3
@@ -25,6 +47,7 @@ type LocalRegMsg struct {
 	Act string             `json:"act"`
 	Usr []*LocalUsrRegItem `json:"usr,omitempty"`
 	Dev []*LocalDevRegItem `json:"dev,omitempty"`
+	Route
 }
 
 type LocalUsrRegItem struct {
@@ -49,12 +72,11 @@ type LocalDevRegItem struct {
 
 // 普通消息Act=6
 type OrdinaryMsg struct {
-	Act    string      `json:"act"`
-	From   string      `json:"from"`
-	To     string      `json:"to"`
-	Msg    interface{} `json:"msg"`
-	Sender string      `json:"-"`
-	Unit   string      `json:"-"`
+	Act  string      `json:"act"`
+	From string      `json:"from"`
+	To   string      `json:"to"`
+	Msg  interface{} `json:"msg"`
+	Route
 }
 
 // 状态消息Act=7
@@ -66,175 +88,199 @@ type ModStatusMsg struct {
 	Msg       interface{} `json:"msg"`
 	CreatedAt int64       `json:"created_at"`
 	UpdatedAt int64       `json:"updated_at"`
-	Sender    string      `json:"-"`
-	Unit      string      `json:"-"`
+	// 更新后的状态版本，由服务端分配
+	Version int64 `json:"version,omitempty"`
+	// 期望的当前版本，不一致时拒绝更新
+	ExpectedVersion *int64 `json:"expected_version,omitempty"`
+	Route
+}
+
+func (m *OrdinaryMsg) GetTo() string {
+	return m.To
+}
+
+func (m *ModStatusMsg) GetTo() string {
+	return m.To
+}
+
+// to为空时发送给单元所有终端
+func (m *ChatTextMsg) GetTo() string {
+	if m.To == "" {
+		return "A"
+	}
+	return m.To
+}
+
+func (m *ContentFlagMsg) GetTo() string {
+	return "T"
+}
+
+func (m *ChatRecallMsg) GetTo() string {
+	if m.To == "" {
+		return "A"
+	}
+	return m.To
 }
 
 // 用户上线消息Act=8
 type UsrOnlineMsg struct {
-	Act    string `json:"act"`
-	Uid    string `json:"uid"`
-	Nm     string `json:"nm"`
-	Sex    string `json:"sex"`
-	Idt    string `json:"idt"`
-	Os     string `json:"os"`
-	Vi     string `json:"vi"`
-	Hw     string `json:"hw"`
-	Sender string `json:"-"`
-	Unit   string `json:"-"`
+	Act string `json:"act"`
+	Uid string `json:"uid"`
+	Nm  string `json:"nm"`
+	Sex string `json:"sex"`
+	Idt string `json:"idt"`
+	Os  string `json:"os"`
+	Vi  string `json:"vi"`
+	Hw  string `json:"hw"`
+	Route
 }
 
 // 用户下线消息Act=9
 type UsrOfflineMsg struct {
-	Act    string `json:"act"`
-	Uid    string `json:"uid"`
-	Sender string `json:"-"`
-	Unit   string `json:"-"`
+	Act string `json:"act"`
+	Uid string `json:"uid"`
+	Route
 }
 
 // 设备上线消息Act=10
 type DevOnlineMsg struct {
-	Act    string `json:"act"`
-	Did    string `json:"did"`
-	Nm     string `json:"nm"`
-	Dt     string `json:"dt"`
-	Vi     string `json:"vi"`
-	Hw     string `json:"hw"`
-	Sender string `json:"-"`
-	Unit   string `json:"-"`
+	Act string `json:"act"`
+	Did string `json:"did"`
+	Nm  string `json:"nm"`
+	Dt  string `json:"dt"`
+	Vi  string `json:"vi"`
+	Hw  string `json:"hw"`
+	Route
 }
 
 // 设备下线消息Act=11
 type DevOfflineMsg struct {
-	Act    string `json:"act"`
-	Did    string `json:"did"`
-	Sender string `json:"-"`
-	Unit   string `json:"-"`
+	Act string `json:"act"`
+	Did string `json:"did"`
+	Route
 }
 
 // 单元控制(开始/结束)消息Act=12
 type UnitControlMsg struct {
-	Act    string      `json:"act"`
-	From   string      `json:"from"`
-	Msg    interface{} `json:"msg"`
-	Sender string      `json:"-"`
-	Unit   string      `json:"-"`
+	Act  string      `json:"act"`
+	From string      `json:"from"`
+	Msg  interface{} `json:"msg"`
+	Route
 }
 
 // 开始接收笔迹Act=13
 type PullInkMsg struct {
-	Act    string `json:"act"`
-	From   string `json:"from"`
-	Get    string `json:"get"`
-	Sender string `json:"-"`
-	Unit   string `json:"-"`
+	Act  string `json:"act"`
+	From string `json:"from"`
+	Get  string `json:"get"`
+	Route
 }
 
 // 结束接收笔迹Act=14
 type EndPullInkMsg struct {
-	Act    string `json:"act"`
-	From   string `json:"from"`
-	Get    string `json:"get"`
-	Sender string `json:"-"`
-	Unit   string `json:"-"`
+	Act  string `json:"act"`
+	From string `json:"from"`
+	Get  string `json:"get"`
+	Route
 }
 
-// 文字聊天消息Act=15
+// 文字聊天消息Act=15，见chat.go
 type ChatTextMsg struct {
 	Act       string      `json:"act"`
+	ChatId    int64       `json:"chat_id,omitempty"`
+	From      string      `json:"from"`
+	To        string      `json:"to,omitempty"`
+	At        []string    `json:"at,omitempty"`
+	Msg       interface{} `json:"msg"`
+	CreatedAt int64       `json:"created_at"`
+	Route
+	// 定向消息的可见者，由服务端计算
+	visible []string
+}
+
+// 敏感词标记消息Act=21，由服务端下发给单元内的老师，Type为原消息的act，From为原消息的发送者，Msg为原消息
+type ContentFlagMsg struct {
+	Act       string      `json:"act"`
+	Type      string      `json:"type"`
 	From      string      `json:"from"`
+	Words     []string    `json:"words"`
 	Msg       interface{} `json:"msg"`
 	CreatedAt int64       `json:"created_at"`
-	Sender    string      `json:"-"`
-	Unit      string      `json:"-"`
+	Route
+}
+
+// 同步消息Act=22，注册完成后由服务端下发给该客户端，包含当前场景、模块状态、最近聊天消息及在线终端
+type SyncMsg struct {
+	Act       string          `json:"act"`
+	SceneId   int             `json:"scene_id"`
+	StartTime int64           `json:"start_time"`
+	Curmod    string          `json:"curmod"`
+	Mods      []*ModStatusMsg `json:"mods"`
+	Chats     []*SyncChat     `json:"chats"`
+	Roster    []interface{}   `json:"roster"`
+	CreatedAt int64           `json:"created_at"`
+	Route
+}
+
+// 同步消息中的聊天消息，已撤回的消息只保留撤回信息
+type SyncChat struct {
+	ChatTextMsg
+	Recalled   bool   `json:"recalled,omitempty"`
+	RecalledBy string `json:"recalled_by,omitempty"`
+	RecalledAt int64  `json:"recalled_at,omitempty"`
+}
+
+// 撤回聊天消息Act=19
+type ChatRecallMsg struct {
+	Act       string `json:"act"`
+	ChatId    int64  `json:"chat_id"`
+	From      string `json:"from"`
+	To        string `json:"to,omitempty"` // 原消息的可见者，由服务端填充
+	CreatedAt int64  `json:"created_at"`
+	Route
+}
+
+// 禁言消息Act=20
+type ChatMuteMsg struct {
+	Act       string `json:"act"`
+	Uid       string `json:"uid,omitempty"` // 为空时禁言全体
+	Mute      bool   `json:"mute"`
+	From      string `json:"from"`
+	CreatedAt int64  `json:"created_at"`
+	Route
+}
+
+// 本地终端消息Act=17，由服务端下发给本地中控，Rcv为本地终端id，Msg为原消息
+type LocalEnvelopeMsg struct {
+	Act string          `json:"act"`
+	Rcv string          `json:"rcv"`
+	Msg json.RawMessage `json:"msg"`
+	Route
+}
+
+// 系统通知消息Act=18，由服务端(管理接口)下发给单元内所有终端
+type SysNoticeMsg struct {
+	Act       string `json:"act"`
+	Msg       string `json:"msg"`
+	CreatedAt int64  `json:"created_at"`
+	Route
 }
 
-// 解组中控Json消息
-func UnmarshalMessage(raw []byte) (interface{}, error) {
+// 解组中控Json消息，消息类型由RegisterAct注册
+func UnmarshalMessage(raw []byte) (Message, error) {
 	message := new(MsgType)
 	err := json.Unmarshal(raw, message)
 	if err != nil {
-		return nil, err
+		return nil, NewError(ErrCodeBadFormat, "Json format error: %s", err)
 	}
-	var dst interface{}
-	switch message.Act {
-	case "1":
-		dst = new(RegMsg)
-	case "2":
-		dst = new(LocalRegMsg)
-	case "3":
-		dst = new(LocalRegMsg)
-	case "6":
-		dst = new(OrdinaryMsg)
-	case "7":
-		dst = new(ModStatusMsg)
-	case "8":
-		dst = new(UsrOnlineMsg)
-	case "9":
-		dst = new(UsrOfflineMsg)
-	case "10":
-		dst = new(DevOnlineMsg)
-	case "11":
-		dst = new(DevOfflineMsg)
-	case "12":
-		dst = new(UnitControlMsg)
-	case "13":
-		dst = new(PullInkMsg)
-	case "14":
-		dst = new(EndPullInkMsg)
-	case "15":
-		dst = new(ChatTextMsg)
-	default:
-		return nil, errors.New("Cannot identify message format.")
+	spec := lookupAct(message.Act)
+	if spec == nil {
+		return nil, NewError(ErrCodeUnknownAct, "Cannot identify message format.")
 	}
+	dst := spec.New()
 	err = json.Unmarshal(raw, dst)
 	if err != nil {
-		return nil, err
+		return nil, NewError(ErrCodeBadFormat, "Json format error: %s", err)
 	}
 	return dst, nil
 }
-
-// Parse the field to of message and return groups and individuals
-func ParseFieldTo(to string) (groups, individuals []string) {
-	if to == "" {
-		return
-	}
-	parts := strings.Split(to, "@")
-	switch {
-	case parts[0] == "A":
-		groups = []string{"A"}
-		return
-	case parts[0] == "T":
-		groups = []string{"T"}
-	case parts[0] == "S":
-		groups = []string{"S"}
-	case parts[0] == "D":
-		groups = []string{"D"}
-	case strings.Index(parts[0], "|") != -1:
-		groups = strings.Split(parts[0], "|")
-		hasA := false
-		for _, v := range groups {
-			if v == "A" {
-				hasA = true
-				break
-			}
-		}
-		if hasA {
-			groups = []string{"A"}
-			return
-		}
-	case strings.Index(parts[0], ",") != -1:
-		individuals = strings.Split(parts[0], ",")
-		return
-	default:
-		individuals = []string{parts[0]}
-		return
-	}
-	if len(parts) > 1 {
-		if parts[1] != "" {
-			ia := strings.Split(parts[1], ",")
-			individuals = append(individuals, ia...)
-		}
-	}
-	return
-}
@@ -0,0 +1,285 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 模块状态：nc:ins:mod:{unit}:{scene}中每个模块一个字段，值为带版本号的ModStatusMsg。
+// > 初始化时version为1，此后每次更新加1
+// > 更新按RFC 7386 merge-patch合并msg，值为null的字段被删除；msg.nm改变时整体替换
+// > 携带expected_version时，与当前版本不一致则拒绝(ErrCodeConflict)，未初始化的版本为0
+// 更新使用WATCH/MULTI保证并发写入时版本号不重复
+
+// 并发写入冲突时的重试次数
+const modStatusRetries = 5
+
+// 模块状态消息Act=7
+func handleModStatus(c *Client, m Message) error {
+	message := m.(*ModStatusMsg)
+	message.CreatedAt = time.Now().Unix()
+	message.Version = 0
+	return nil
+}
+
+// 更新当前单元模块状态，并记录状态指令历史。未指定mod时更新当前模块，更新成功后才切换当前模块
+func persistModStatus(c *Client, m Message) error {
+	message := m.(*ModStatusMsg)
+	mod := message.Mod
+	if mod == "" {
+		mod = c.unitInfo.Curmod
+	}
+	modInsKey := fmt.Sprintf(modInsKeyFormat, c.unitId, c.unitInfo.SceneId)
+	modInsHisKey := fmt.Sprintf(modInsHistoryKeyFormat, c.unitId, c.unitInfo.SceneId, mod)
+
+	for i := 0; i < modStatusRetries; i++ {
+		if _, err := c.redconn.Do("WATCH", modInsKey); err != nil {
+			c.logout(message.Act, storageError(err))
+			return ErrDiscard
+		}
+		ret, err := redis.Bytes(c.redconn.Do("HGET", modInsKey, mod))
+		if err != nil && err != redis.ErrNil {
+			log.Printf("[%s] Failed to hget %s, error: %s\n", c.id, modInsKey, err)
+			c.redconn.Do("UNWATCH")
+			c.logout(message.Act, storageError(err))
+			return ErrDiscard
+		}
+
+		curstat, err := nextModStatus(ret, message)
+		if err != nil {
+			c.redconn.Do("UNWATCH")
+			return err
+		}
+		storeData, _ := json.Marshal(curstat)
+		// 重试时需保留原指令的expected_version
+		history := *message
+		history.Version = curstat.Version
+		history.ExpectedVersion = nil
+		hisData, _ := json.Marshal(&history)
+
+		c.redconn.Send("MULTI")
+		c.redconn.Send("HSET", modInsKey, mod, storeData)
+		c.redconn.Send("RPUSH", modInsHisKey, hisData)
+		reply, err := c.redconn.Do("EXEC")
+		if err != nil {
+			log.Printf("[%s] Failed to update %s, error: %s\n", c.id, modInsKey, err)
+			c.logout(message.Act, storageError(err))
+			return ErrDiscard
+		}
+		if reply == nil {
+			// 其它终端同时修改了模块状态，重新读取
+			log.Printf("[%s] Concurrent update on %s, retry\n", c.id, modInsKey)
+			continue
+		}
+		log.Printf("[%s] HSET %s %s %s\n", c.id, modInsKey, mod, storeData)
+		log.Printf("[%s] RPUSH %s %s\n", c.id, modInsHisKey, hisData)
+		message.Version = curstat.Version
+		message.ExpectedVersion = nil
+		c.unitInfo.Curmod = mod
+		return nil
+	}
+	return NewError(ErrCodeConflict, "too many concurrent updates on module %s", mod)
+}
+
+// 根据当前状态(未初始化时为nil)及更新指令计算新状态
+func nextModStatus(ret []byte, message *ModStatusMsg) (*ModStatusMsg, error) {
+	curstat := new(ModStatusMsg)
+	if ret != nil {
+		if err := json.Unmarshal(ret, curstat); err != nil {
+			return nil, storageError(err)
+		}
+	}
+	if message.ExpectedVersion != nil && *message.ExpectedVersion != curstat.Version {
+		return nil, NewError(ErrCodeConflict, "version conflict, expected %d, current %d", *message.ExpectedVersion, curstat.Version)
+	}
+
+	if ret == nil {
+		if message.Mod == "" {
+			return nil, NewError(ErrCodeMissingField, "Field 'mod' or 'to' not exists, can't be init, discard the instruction.")
+		}
+		*curstat = *message
+		curstat.Version = 0
+		curstat.ExpectedVersion = nil
+		curstat.Msg = mergePatch(nil, message.Msg)
+	} else {
+		if message.Msg == nil {
+			return nil, NewError(ErrCodeMissingField, "field 'msg' not exists, discard the instruction")
+		}
+		curstat.To = message.To
+		incrmsg, _ := message.Msg.(map[string]interface{})
+		currmsg, ok := curstat.Msg.(map[string]interface{})
+		if !ok || (incrmsg["nm"] != nil && incrmsg["nm"] != currmsg["nm"]) {
+			curstat.Msg = mergePatch(nil, message.Msg)
+		} else {
+			curstat.Msg = mergePatch(currmsg, message.Msg)
+		}
+	}
+	curstat.UpdatedAt = time.Now().Unix()
+	curstat.Version++
+	return curstat, nil
+}
+
+// RFC 7386 JSON Merge Patch：patch为对象时逐字段合并，null删除字段；否则整体替换
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{}, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// 模块状态指令历史的查询条件，为零值的条件不过滤
+type modListQuery struct {
+	Mod       string
+	From      string
+	StartTime int64
+	EndTime   int64
+	// 上一页最后一条指令的id
+	Cursor string
+	Limit  int
+}
+
+// 每次从历史列表读取的指令数
+const modListChunk = 100
+
+// 指令id为"{模块}:{序号}"，序号即指令在nc:ins:mod:his:{unit}:{scene}:{mod}中的位置(从1开始)，
+// 历史列表只追加，id不变
+func modInstructionId(mod string, n int) string {
+	return mod + ":" + strconv.Itoa(n)
+}
+
+func parseModInstructionId(id string) (string, int, error) {
+	i := strings.LastIndex(id, ":")
+	if i < 0 {
+		return "", 0, errors.New("bad cursor")
+	}
+	n, err := strconv.Atoi(id[i+1:])
+	if err != nil || n <= 0 {
+		return "", 0, errors.New("bad cursor")
+	}
+	return id[:i], n, nil
+}
+
+// 查询场景的模块状态指令：模块按其第一条指令的时间升序，模块内按指令顺序。
+// 返回一页指令及下一页的游标，没有更多指令时游标为空
+func modInstructions(redconn redis.Conn, unitId string, sceneId int, q modListQuery) ([]map[string]interface{}, string, error) {
+	mods, err := redis.Strings(redconn.Do("HKEYS", fmt.Sprintf(modInsKeyFormat, unitId, sceneId)))
+	if err != nil {
+		return nil, "", err
+	}
+
+	type modHistory struct {
+		mod   string
+		key   string
+		first int64
+	}
+	histories := make([]*modHistory, 0, len(mods))
+	for _, mod := range mods {
+		if q.Mod != "" && mod != q.Mod {
+			continue
+		}
+		h := &modHistory{mod: mod, key: fmt.Sprintf(modInsHistoryKeyFormat, unitId, sceneId, mod)}
+		b, err := redis.Bytes(redconn.Do("LINDEX", h.key, 0))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		var modins ModStatusMsg
+		if err := json.Unmarshal(b, &modins); err != nil {
+			return nil, "", err
+		}
+		h.first = modins.CreatedAt
+		histories = append(histories, h)
+	}
+	sort.Slice(histories, func(i, j int) bool {
+		if histories[i].first != histories[j].first {
+			return histories[i].first < histories[j].first
+		}
+		return histories[i].mod < histories[j].mod
+	})
+
+	// 定位游标
+	start, offset := 0, 0
+	if q.Cursor != "" {
+		mod, n, err := parseModInstructionId(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		start = -1
+		for i, h := range histories {
+			if h.mod == mod {
+				start, offset = i, n
+				break
+			}
+		}
+		if start < 0 {
+			return nil, "", errors.New("bad cursor")
+		}
+	}
+
+	list := make([]map[string]interface{}, 0)
+	for i := start; i < len(histories); i++ {
+		h := histories[i]
+		if i > start {
+			offset = 0
+		}
+		for {
+			res, err := redis.ByteSlices(redconn.Do("LRANGE", h.key, offset, offset+modListChunk-1))
+			if err != nil {
+				return nil, "", err
+			}
+			for k, v := range res {
+				var modins ModStatusMsg
+				if err := json.Unmarshal(v, &modins); err != nil {
+					return nil, "", err
+				}
+				// 历史按时间追加，超出结束时间后不再读取该模块
+				if q.EndTime > 0 && modins.CreatedAt > q.EndTime {
+					res = nil
+					break
+				}
+				if (q.From != "" && modins.From != q.From) || modins.CreatedAt < q.StartTime {
+					continue
+				}
+				id := modInstructionId(h.mod, offset+k+1)
+				list = append(list, map[string]interface{}{
+					"id":         id,
+					"mod":        h.mod,
+					"from":       modins.From,
+					"msg":        modins.Msg,
+					"version":    modins.Version,
+					"created_at": time.Unix(modins.CreatedAt, 0).Format("2006-01-02 15:04:05"),
+				})
+				if q.Limit > 0 && len(list) == q.Limit {
+					return list, id, nil
+				}
+			}
+			if len(res) < modListChunk {
+				break
+			}
+			offset += modListChunk
+		}
+	}
+	return list, "", nil
+}
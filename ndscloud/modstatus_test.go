@@ -0,0 +1,242 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// 解析JSON，用于构造及比较msg
+func mustJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	if s == "" {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("bad json %s: %s", s, err)
+	}
+	return v
+}
+
+func jsonString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// RFC 7386 附录A的用例
+func TestMergePatch(t *testing.T) {
+	cases := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, c := range cases {
+		t.Run(c.target+" "+c.patch, func(t *testing.T) {
+			got := mergePatch(mustJSON(t, c.target), mustJSON(t, c.patch))
+			if jsonString(got) != jsonString(mustJSON(t, c.want)) {
+				t.Errorf("got %s, want %s", jsonString(got), c.want)
+			}
+		})
+	}
+}
+
+func TestNextModStatus(t *testing.T) {
+	version := func(v int64) *int64 { return &v }
+	cases := []struct {
+		name     string
+		cur      string // 当前状态，为空时未初始化
+		mod      string
+		to       string
+		msg      string
+		expected *int64
+		want     string // 更新后的msg
+		version  int64
+		code     int
+	}{
+		{name: "init", mod: "m1", msg: `{"a":1,"b":null}`, want: `{"a":1}`, version: 1},
+		{name: "init without mod", msg: `{"a":1}`, code: ErrCodeMissingField},
+		{name: "init expected 0", mod: "m1", msg: `{"a":1}`, expected: version(0), want: `{"a":1}`, version: 1},
+		{name: "init expected 1", mod: "m1", msg: `{"a":1}`, expected: version(1), code: ErrCodeConflict},
+		{name: "update without msg", cur: `{"version":1,"msg":{"a":1}}`, code: ErrCodeMissingField},
+		{name: "null deletes", cur: `{"version":1,"msg":{"a":1,"b":2}}`, msg: `{"b":null}`, want: `{"a":1}`, version: 2},
+		{name: "nested merge", cur: `{"version":2,"msg":{"a":{"x":1,"y":2},"b":1}}`, msg: `{"a":{"y":null,"z":3}}`, want: `{"a":{"x":1,"z":3},"b":1}`, version: 3},
+		{name: "non-object patch replaces", cur: `{"version":1,"msg":{"a":1}}`, msg: `"page"`, want: `"page"`, version: 2},
+		{name: "non-object target replaced", cur: `{"version":1,"msg":[1,2]}`, msg: `{"a":1,"b":null}`, want: `{"a":1}`, version: 2},
+		{name: "same nm merges", cur: `{"version":1,"msg":{"nm":"p1","a":1}}`, msg: `{"nm":"p1","b":2}`, want: `{"a":1,"b":2,"nm":"p1"}`, version: 2},
+		{name: "nm change replaces", cur: `{"version":1,"msg":{"nm":"p1","a":1}}`, msg: `{"nm":"p2","b":2}`, want: `{"b":2,"nm":"p2"}`, version: 2},
+		{name: "expected version", cur: `{"version":3,"msg":{"a":1}}`, msg: `{"a":2}`, expected: version(3), want: `{"a":2}`, version: 4},
+		{name: "version conflict", cur: `{"version":3,"msg":{"a":1}}`, msg: `{"a":2}`, expected: version(2), code: ErrCodeConflict},
+		{name: "to updated", cur: `{"version":1,"to":"A","msg":{"a":1}}`, to: "T", msg: `{"a":2}`, want: `{"a":2}`, version: 2},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var cur []byte
+			if c.cur != "" {
+				cur = []byte(c.cur)
+			}
+			message := &ModStatusMsg{Act: "7", Mod: c.mod, To: c.to, Msg: mustJSON(t, c.msg), ExpectedVersion: c.expected}
+			got, err := nextModStatus(cur, message)
+			if errCode(err) != c.code {
+				t.Fatalf("got error %v, want code %d", err, c.code)
+			}
+			if err != nil {
+				return
+			}
+			if jsonString(got.Msg) != jsonString(mustJSON(t, c.want)) {
+				t.Errorf("msg %s, want %s", jsonString(got.Msg), c.want)
+			}
+			if got.Version != c.version {
+				t.Errorf("version %d, want %d", got.Version, c.version)
+			}
+			if got.ExpectedVersion != nil {
+				t.Errorf("expected_version stored")
+			}
+			if c.to != "" && got.To != c.to {
+				t.Errorf("to %q, want %q", got.To, c.to)
+			}
+		})
+	}
+}
+
+func TestModInstructionId(t *testing.T) {
+	id := modInstructionId("m:1", 12)
+	if id != "m:1:12" {
+		t.Errorf("got %s", id)
+	}
+	if mod, n, err := parseModInstructionId(id); err != nil || mod != "m:1" || n != 12 {
+		t.Errorf("parse %s: got %s, %d, %v", id, mod, n, err)
+	}
+	for _, id := range []string{"", "m1", "m1:", "m1:x", "m1:0", "m1:-1"} {
+		if _, _, err := parseModInstructionId(id); err == nil {
+			t.Errorf("parse %q: got no error", id)
+		}
+	}
+}
+
+// 模块按第一条指令的时间升序：m2(100起)、m1(110起)
+func newModHistoryRedis() *fakeRedis {
+	r := newFakeRedis()
+	r.hashes[fmt.Sprintf(modInsKeyFormat, "u1", 1)] = map[string]string{"m1": "{}", "m2": "{}", "m3": "{}"}
+	m1 := fmt.Sprintf(modInsHistoryKeyFormat, "u1", 1, "m1")
+	m2 := fmt.Sprintf(modInsHistoryKeyFormat, "u1", 1, "m2")
+	for i, from := range []string{"t1", "t2", "t1"} {
+		r.rpush(m1, &ModStatusMsg{Mod: "m1", From: from, CreatedAt: int64(110 + i*10), Version: int64(i + 1)})
+	}
+	for i, from := range []string{"t1", "t1"} {
+		r.rpush(m2, &ModStatusMsg{Mod: "m2", From: from, CreatedAt: int64(100 + i*100), Version: int64(i + 1)})
+	}
+	// m3没有指令历史
+	return r
+}
+
+func TestModInstructions(t *testing.T) {
+	r := newModHistoryRedis()
+	cases := []struct {
+		name  string
+		q     modListQuery
+		pages string // 各页的指令id，页之间以|分隔
+	}{
+		{name: "all", q: modListQuery{}, pages: "m2:1 m2:2 m1:1 m1:2 m1:3"},
+		{name: "limit 2", q: modListQuery{Limit: 2}, pages: "m2:1 m2:2|m1:1 m1:2|m1:3"},
+		{name: "limit 3", q: modListQuery{Limit: 3}, pages: "m2:1 m2:2 m1:1|m1:2 m1:3"},
+		{name: "mod", q: modListQuery{Mod: "m1", Limit: 2}, pages: "m1:1 m1:2|m1:3"},
+		{name: "from", q: modListQuery{From: "t2"}, pages: "m1:2"},
+		{name: "time", q: modListQuery{StartTime: 110, EndTime: 120, Limit: 1}, pages: "m1:1|m1:2"},
+		{name: "cursor", q: modListQuery{Cursor: "m2:1"}, pages: "m2:2 m1:1 m1:2 m1:3"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pages := make([]string, 0)
+			q := c.q
+			for i := 0; i < 10; i++ {
+				list, next, err := modInstructions(r, "u1", 1, q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids := make([]string, 0, len(list))
+				for _, item := range list {
+					ids = append(ids, item["id"].(string))
+				}
+				if len(ids) > 0 {
+					pages = append(pages, strings.Join(ids, " "))
+				}
+				if next == "" {
+					break
+				}
+				if next != ids[len(ids)-1] {
+					t.Errorf("cursor %s is not the last id %s", next, ids[len(ids)-1])
+				}
+				q.Cursor = next
+			}
+			if got := strings.Join(pages, "|"); got != c.pages {
+				t.Errorf("got %s, want %s", got, c.pages)
+			}
+		})
+	}
+
+	for _, cursor := range []string{"m9:1", "bad"} {
+		if _, _, err := modInstructions(r, "u1", 1, modListQuery{Cursor: cursor}); err == nil {
+			t.Errorf("cursor %s: got no error", cursor)
+		}
+	}
+}
+
+// 更新成功后才切换当前模块
+func TestPersistModStatus(t *testing.T) {
+	r := newFakeRedis()
+	c := newChatClient(r, "t1", 1)
+	c.unitInfo.Curmod = "m0"
+	five := int64(5)
+
+	message := &ModStatusMsg{Act: "7", Mod: "m1", Msg: map[string]interface{}{"a": 1.0}, ExpectedVersion: &five}
+	if err := persistModStatus(c, message); errCode(err) != ErrCodeConflict {
+		t.Fatalf("got %v, want conflict", err)
+	}
+	if c.unitInfo.Curmod != "m0" {
+		t.Errorf("curmod switched to %s by a rejected update", c.unitInfo.Curmod)
+	}
+
+	r.conflicts = 1
+	message = &ModStatusMsg{Act: "7", Mod: "m1", Msg: map[string]interface{}{"a": 1.0}}
+	if err := persistModStatus(c, message); err != nil {
+		t.Fatal(err)
+	}
+	if c.unitInfo.Curmod != "m1" || message.Version != 1 {
+		t.Errorf("got curmod %s, version %d", c.unitInfo.Curmod, message.Version)
+	}
+	// 未指定mod时更新当前模块
+	message = &ModStatusMsg{Act: "7", Msg: map[string]interface{}{"b": 2.0}}
+	if err := persistModStatus(c, message); err != nil {
+		t.Fatal(err)
+	}
+	stored := r.hashes[fmt.Sprintf(modInsKeyFormat, "u1", 1)]["m1"]
+	if !strings.Contains(stored, `"version":2`) || !strings.Contains(stored, `"msg":{"a":1,"b":2}`) {
+		t.Errorf("stored %s", stored)
+	}
+	if n := len(r.lists[fmt.Sprintf(modInsHistoryKeyFormat, "u1", 1, "m1")]); n != 2 {
+		t.Errorf("got %d history entries, want 2", n)
+	}
+
+	// 过期的expected_version被拒绝
+	stale := int64(1)
+	message = &ModStatusMsg{Act: "7", Msg: map[string]interface{}{"c": 3.0}, ExpectedVersion: &stale}
+	if err := persistModStatus(c, message); errCode(err) != ErrCodeConflict {
+		t.Errorf("got %v, want conflict", err)
+	}
+}
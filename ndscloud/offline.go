@@ -0,0 +1,154 @@
+package ndscloud
+
+import (
+	"log"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+)
+
+// 断线下线消息：客户端断线后等待宽限期，期间未重新注册则推送下线消息(Act=9/11)，
+// 本地中控断线时一并推送其本地终端的下线消息。
+// 宽限期内同一id在同一单元重新注册，不推送下线消息，也不推送重复的上线消息；
+// 重连的本地中控重新上报的本地终端不推送上线消息，宽限期后仍未上报的推送下线消息。
+//
+// 客户端主动下线(Act=9/11且为自身)、单元结束时不推送。
+
+const (
+	// 默认宽限期
+	offlineGrace = 10 * time.Second
+)
+
+// 等待宽限期的断线客户端
+type offline struct {
+	client *Client
+	timer  *time.Timer
+	// 本地中控上报的本地终端，id => 是否为用户
+	locals map[string]bool
+}
+
+func offlineGracePeriod() time.Duration {
+	switch grace := config.Config.Cc.OfflineGrace; {
+	case grace < 0:
+		return 0
+	case grace > 0:
+		return time.Duration(grace) * time.Second
+	}
+	return offlineGrace
+}
+
+// 本地中控上报的本地终端
+func localsOf(c *Client) map[string]bool {
+	locals := make(map[string]bool)
+	for _, item := range c.localUsers.List() {
+		locals[item.Uid] = true
+	}
+	for _, item := range c.localDevices.List() {
+		locals[item.Did] = false
+	}
+	return locals
+}
+
+// 宽限期后推送下线消息，调用者持有Hub.mutex
+func (h *Hub) scheduleOfflineLocked(c *Client) {
+	if o, ok := h.pending[c.id]; ok {
+		o.timer.Stop()
+	}
+	o := &offline{client: c, locals: localsOf(c)}
+	o.timer = time.AfterFunc(offlineGracePeriod(), func() {
+		h.mutex.Lock()
+		if h.pending[c.id] != o {
+			h.mutex.Unlock()
+			return
+		}
+		delete(h.pending, c.id)
+		h.mutex.Unlock()
+
+		h.sendOffline(c, c.id, o.locals)
+	})
+	h.pending[c.id] = o
+}
+
+// 客户端在宽限期内重新注册，取消推送下线消息；返回nil表示不在宽限期内
+func (h *Hub) cancelOffline(c *Client) *offline {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	o, ok := h.pending[c.id]
+	if !ok || o.client.unitId != c.unitId {
+		return nil
+	}
+	if !o.timer.Stop() {
+		// 计时器已触发，下线消息正在推送
+		return nil
+	}
+	delete(h.pending, c.id)
+	log.Printf("[%s] Reconnected within grace period\n", c.id)
+	return o
+}
+
+// 推送下线消息，id为断线的客户端，locals为随之下线的本地终端；id为空时只推送本地终端
+func (h *Hub) sendOffline(c *Client, id string, locals map[string]bool) {
+	route := Route{Sender: c.id, Unit: c.unitId}
+	if id != "" {
+		if c.isDevice() {
+			h.dispatch(&DevOfflineMsg{Act: "11", Did: id, Route: route})
+		} else {
+			h.dispatch(&UsrOfflineMsg{Act: "9", Uid: id, Route: route})
+		}
+	}
+	for localId, isUser := range locals {
+		if isUser {
+			h.dispatch(&UsrOfflineMsg{Act: "9", Uid: localId, Route: route})
+		} else {
+			h.dispatch(&DevOfflineMsg{Act: "11", Did: localId, Route: route})
+		}
+	}
+	log.Printf("[%s] Offline, unit: %s, local terminals: %d\n", c.id, c.unitId, len(locals))
+}
+
+// 重连的本地中控接管断线前的本地终端，宽限期后推送仍未重新上报的本地终端的下线消息
+func (c *Client) carryLocals(locals map[string]bool) {
+	if len(locals) == 0 {
+		return
+	}
+	c.mtx.Lock()
+	c.carried = locals
+	c.mtx.Unlock()
+
+	time.AfterFunc(offlineGracePeriod(), func() {
+		c.mtx.Lock()
+		locals := c.carried
+		c.carried = nil
+		c.mtx.Unlock()
+
+		if len(locals) > 0 {
+			c.hub.sendOffline(c, "", locals)
+		}
+	})
+}
+
+// 本地终端是否为断线前上报过的，是则不再推送上线消息
+func (c *Client) uncarry(id string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, ok := c.carried[id]; ok {
+		delete(c.carried, id)
+		return true
+	}
+	return false
+}
+
+// 标记客户端主动下线，断线后不再推送下线消息
+func (c *Client) leave() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.left = true
+}
+
+func (c *Client) hasLeft() bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.left
+}
@@ -1,3 +1,109 @@
 package ndscloud
 
 // Parse message to Packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// 笔迹流指令
+const (
+	PmsActRewrite    byte = 0 // 重写
+	PmsActRegister   byte = 1 // 注册
+	PmsActUpdate     byte = 2 // 更新
+	PmsActCoordinate byte = 3 // 坐标
+	PmsActClear      byte = 4 // 清空
+	PmsActUndo       byte = 5 // 撤销
+)
+
+// 笔迹流基本格式(重写/清空/撤销)
+type BasicMsg struct {
+	Typ byte    // 1字节整数
+	Uid [5]byte // 5字节整数
+	Act byte    // 1字节整数
+}
+
+// 笔迹注册指令
+type RegisterMsg struct {
+	BasicMsg
+	Width  [2]byte // 2字节整数
+	Height [2]byte // 2字节整数
+}
+
+// 笔迹更新指令
+type UpdateMsg struct {
+	BasicMsg
+	R    byte // 1字节整数
+	G    byte // 1字节整数
+	B    byte // 1字节整数
+	Size byte // 1字节整数
+}
+
+// 笔迹坐标指令
+type CoordinateMsg struct {
+	BasicMsg
+	X        [2]byte
+	Y        [2]byte
+	Pressure byte
+	State    byte
+}
+
+// 笔迹流消息，Raw为原始二进制帧
+type PmsMsg struct {
+	Uid    string
+	Act    byte
+	Frame  interface{}
+	Raw    []byte
+	Sender string
+	Unit   string
+	Scene  int
+}
+
+// 解组笔迹流二进制帧
+func UnmarshalPacket(raw []byte) (*PmsMsg, error) {
+	basic := new(BasicMsg)
+	if len(raw) < binary.Size(basic) {
+		return nil, errors.New("Ink frame too short.")
+	}
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, basic); err != nil {
+		return nil, err
+	}
+
+	var dst interface{}
+	switch basic.Act {
+	case PmsActRewrite, PmsActClear, PmsActUndo:
+		dst = basic
+	case PmsActRegister:
+		dst = new(RegisterMsg)
+	case PmsActUpdate:
+		dst = new(UpdateMsg)
+	case PmsActCoordinate:
+		dst = new(CoordinateMsg)
+	default:
+		return nil, errors.New("Cannot identify ink frame format.")
+	}
+	if len(raw) != binary.Size(dst) {
+		return nil, errors.New("Bad ink frame length.")
+	}
+	if dst != basic {
+		if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, dst); err != nil {
+			return nil, err
+		}
+	}
+
+	// 5字节大端整数转换为用户id
+	var uid uint64
+	for _, b := range basic.Uid {
+		uid = uid<<8 | uint64(b)
+	}
+
+	return &PmsMsg{
+		Uid:   strconv.FormatUint(uid, 10),
+		Act:   basic.Act,
+		Frame: dst,
+		Raw:   raw,
+	}, nil
+}
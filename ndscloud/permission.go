@@ -0,0 +1,78 @@
+package ndscloud
+
+import (
+	"log"
+
+	"github.com/darling-kefan/xj/config"
+)
+
+// 消息权限：每个act可声明允许发送的角色(ActSpec.Roles)，配置Cc.Permissions可按act覆盖，如
+//
+//	[Cc.Permissions]
+//	"12" = ["teacher", "local_control"]
+//	"7"  = ["teacher", "device", "local_control"]
+//
+// 未声明的act不限制；Act=1(注册)不受限制。
+
+// 角色
+const (
+	RoleTeacher      = "teacher"       // 用户，identity==1
+	RoleStudent      = "student"       // 其它用户
+	RoleDevice       = "device"        // 设备(本地中控除外)
+	RoleLocalControl = "local_control" // 本地中控
+)
+
+// 客户端角色
+func (c *Client) role() string {
+	switch {
+	case c.isLocalControl():
+		return RoleLocalControl
+	case c.isDevice():
+		return RoleDevice
+	case c.identity == 1:
+		return RoleTeacher
+	}
+	return RoleStudent
+}
+
+// 允许发送该act的角色，nil表示不限制
+func rolesOf(spec *ActSpec) []string {
+	if roles, ok := config.Config.Cc.Permissions[spec.Act]; ok {
+		return roles
+	}
+	return spec.Roles
+}
+
+// 客户端是否有权发送该act
+func (c *Client) permitted(spec *ActSpec) bool {
+	if spec.Act == "1" {
+		return true
+	}
+	roles := rolesOf(spec)
+	if roles == nil {
+		return true
+	}
+	role := c.role()
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查配置的权限，未知的act或角色记录日志
+func checkPermissions() {
+	for act, roles := range config.Config.Cc.Permissions {
+		if lookupAct(act) == nil {
+			log.Printf("[permission] Unknown act %s in Cc.Permissions\n", act)
+		}
+		for _, role := range roles {
+			switch role {
+			case RoleTeacher, RoleStudent, RoleDevice, RoleLocalControl:
+			default:
+				log.Printf("[permission] Unknown role %s for act %s in Cc.Permissions\n", role, act)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+	"github.com/gomodule/redigo/redis"
+)
+
+// 在线记录：其它服务及其它节点无需访问Hub即可查询单元在线终端
+// > nc:onlines:{unit}            已注册的客户端，id => Presence
+// > nc:onlines:lc:{unit}:{lcid}  本地中控上报的本地终端，id => LocalPresence
+// 客户端收到pong时续期；记录的expire_at早于当前时间即视为离线。
+
+const (
+	// 默认在线记录过期时间(秒)
+	presenceTTL = 120
+)
+
+// 已注册客户端的在线记录
+type Presence struct {
+	Id           string `json:"id"`
+	Type         string `json:"type"` // user, device, local_control
+	Identity     int    `json:"identity"`
+	Classroom    string `json:"classroom"`
+	Node         string `json:"node"`
+	Conn         string `json:"conn"` // 连接标识，用于区分同一id的新旧连接
+	RegisteredAt int64  `json:"registered_at"`
+	ExpireAt     int64  `json:"expire_at"`
+}
+
+// 本地终端的在线记录
+type LocalPresence struct {
+	Id           string `json:"id"`
+	Type         string `json:"type"` // user, device
+	Nm           string `json:"nm"`
+	Idt          string `json:"idt,omitempty"`
+	Dt           string `json:"dt,omitempty"`
+	RegisteredAt int64  `json:"registered_at"`
+}
+
+// 删除同一连接的在线记录，避免删除同一id新连接的记录
+// KEYS[1]: onlines key, ARGV[1]: id, ARGV[2]: conn
+var presenceOfflineScript = redis.NewScript(1, `
+local v = redis.call('HGET', KEYS[1], ARGV[1])
+if v and cjson.decode(v)['conn'] == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+func presenceExpire() int {
+	if config.Config.Cc.PresenceTTL > 0 {
+		return config.Config.Cc.PresenceTTL
+	}
+	return presenceTTL
+}
+
+// 写入(续期)客户端的在线记录，本地中控同时续期其本地终端
+func (h *Hub) setOnline(c *Client) {
+	ttl := presenceExpire()
+	presence := &Presence{
+		Id:           c.id,
+		Type:         "user",
+		Identity:     c.identity,
+		Classroom:    c.classroom(),
+		Node:         h.node(),
+		Conn:         strconv.FormatInt(c.registeredAt, 10),
+		RegisteredAt: c.registeredAt / int64(time.Second),
+		ExpireAt:     time.Now().Unix() + int64(ttl),
+	}
+	if c.isLocalControl() {
+		presence.Type = "local_control"
+	} else if c.isDevice() {
+		presence.Type = "device"
+	}
+	b, err := json.Marshal(presence)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	conn := h.pool.Get()
+	defer conn.Close()
+
+	onlinesKey := fmt.Sprintf(onlinesKeyFormat, c.unitId)
+	conn.Send("MULTI")
+	conn.Send("HSET", onlinesKey, c.id, b)
+	conn.Send("EXPIRE", onlinesKey, ttl)
+	if c.isLocalControl() {
+		conn.Send("EXPIRE", fmt.Sprintf(localOnlinesKeyFormat, c.unitId, c.id), ttl)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		log.Printf("[%s] Failed to refresh %s, error: %s\n", c.id, onlinesKey, err)
+	}
+}
+
+// 删除客户端的在线记录，本地中控同时删除其本地终端
+func (h *Hub) setOffline(c *Client) {
+	conn := h.pool.Get()
+	defer conn.Close()
+
+	onlinesKey := fmt.Sprintf(onlinesKeyFormat, c.unitId)
+	if _, err := presenceOfflineScript.Do(conn, onlinesKey, c.id, strconv.FormatInt(c.registeredAt, 10)); err != nil {
+		log.Printf("[%s] Failed to hdel %s, error: %s\n", c.id, onlinesKey, err)
+	}
+	if c.isLocalControl() {
+		localOnlinesKey := fmt.Sprintf(localOnlinesKeyFormat, c.unitId, c.id)
+		if _, err := conn.Do("DEL", localOnlinesKey); err != nil {
+			log.Printf("[%s] Failed to del %s, error: %s\n", c.id, localOnlinesKey, err)
+		}
+	}
+}
+
+// 写入本地中控上报的本地终端(全量)
+func (h *Hub) setLocalOnlines(c *Client) {
+	args := redis.Args{fmt.Sprintf(localOnlinesKeyFormat, c.unitId, c.id)}
+	for _, item := range c.localUsers.List() {
+		b, _ := json.Marshal(&LocalPresence{Id: item.Uid, Type: "user", Nm: item.Nm, Idt: item.Idt, RegisteredAt: item.RegisteredAt})
+		args = args.Add(item.Uid, b)
+	}
+	for _, item := range c.localDevices.List() {
+		b, _ := json.Marshal(&LocalPresence{Id: item.Did, Type: "device", Nm: item.Nm, Dt: item.Dt, RegisteredAt: item.RegisteredAt})
+		args = args.Add(item.Did, b)
+	}
+
+	conn := h.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", args[0])
+	if len(args) > 1 {
+		conn.Send("HSET", args...)
+		conn.Send("EXPIRE", args[0], presenceExpire())
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		log.Printf("[%s] Failed to set %s, error: %s\n", c.id, args[0], err)
+	}
+}
+
+// 删除本地终端的在线记录
+func (h *Hub) setLocalOffline(c *Client, id string) {
+	conn := h.pool.Get()
+	defer conn.Close()
+
+	localOnlinesKey := fmt.Sprintf(localOnlinesKeyFormat, c.unitId, c.id)
+	if _, err := conn.Do("HDEL", localOnlinesKey, id); err != nil {
+		log.Printf("[%s] Failed to hdel %s, error: %s\n", c.id, localOnlinesKey, err)
+	}
+}
+
+// 查询单元在线终端(含所有节点)，清理已过期的记录
+func (h *Hub) onlines(unitId string) ([]*Presence, error) {
+	conn := h.pool.Get()
+	defer conn.Close()
+
+	onlinesKey := fmt.Sprintf(onlinesKeyFormat, unitId)
+	values, err := redis.StringMap(conn.Do("HGETALL", onlinesKey))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	list := make([]*Presence, 0, len(values))
+	for id, value := range values {
+		presence := new(Presence)
+		if err := json.Unmarshal([]byte(value), presence); err != nil {
+			// 无法解析的记录脚本中cjson也无法解析，直接删除
+			log.Printf("Failed to decode %s %s, error: %s\n", onlinesKey, id, err)
+			if _, err := conn.Do("HDEL", onlinesKey, id); err != nil {
+				log.Printf("Failed to hdel %s, error: %s\n", onlinesKey, err)
+			}
+			continue
+		}
+		if presence.ExpireAt < now {
+			presenceOfflineScript.Do(conn, onlinesKey, id, presence.Conn)
+			continue
+		}
+		list = append(list, presence)
+	}
+	return list, nil
+}
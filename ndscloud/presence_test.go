@@ -0,0 +1,42 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 查询在线终端时清理过期及无法解析的记录
+func TestOnlines(t *testing.T) {
+	r := newFakeRedis()
+	h := &Hub{pool: &redis.Pool{Dial: func() (redis.Conn, error) { return r, nil }}}
+	onlinesKey := fmt.Sprintf(onlinesKeyFormat, "u1")
+	now := time.Now().Unix()
+	for _, p := range []*Presence{
+		{Id: "t1", Conn: "1", ExpireAt: now + 60},
+		{Id: "s1", Conn: "2", ExpireAt: now - 1},
+	} {
+		b, _ := json.Marshal(p)
+		r.exec("HSET", onlinesKey, p.Id, b)
+	}
+	r.exec("HSET", onlinesKey, "s2", `{"id":"s2",`)
+
+	list, err := h.onlines("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Id != "t1" {
+		t.Errorf("got %d onlines, want t1 only", len(list))
+	}
+	for _, id := range []string{"s1", "s2"} {
+		if _, ok := r.hashes[onlinesKey][id]; ok {
+			t.Errorf("%s not removed", id)
+		}
+	}
+	if _, ok := r.hashes[onlinesKey]["t1"]; !ok {
+		t.Error("t1 removed")
+	}
+}
@@ -12,396 +12,424 @@ import (
 
 // 负责从客户端接收消息，并解析、处理、转发等
 // 主要包括：json消息(文本消息)处理器 和 笔迹流消息处理器
+// json消息按act在注册表(registry.go)中查找处理方式
+// 消息携带rid时，处理完毕(含持久化)后回复确认，失败时回复的错误同样带回rid
 func (c *Client) process(raw []byte) {
-	unmarshalRaw, err := UnmarshalMessage(raw)
+	mt := new(MsgType)
+	json.Unmarshal(raw, mt)
+	c.rid = mt.Rid
+	// 注册完成后，在确认之后推送同步消息
+	defer func() {
+		if c.syncPending {
+			c.syncPending = false
+			c.sync()
+		}
+	}()
+	defer c.ack(mt.Act)
+
+	message, err := UnmarshalMessage(raw)
 	if err != nil {
 		log.Printf("[%s] %s\n", c.id, err)
+		c.notice(mt.Act, err)
 		return
 	}
+	spec := specOf(message)
+	*message.GetRoute() = Route{Sender: c.id, Unit: c.unitId}
 
-	switch message := unmarshalRaw.(type) {
-	case *RegMsg:
-		// 判断注册消息是否和客户端身份匹配
-		if (c.isDevice() && message.Dt == "") || (c.isUser() && message.Dt != "") {
-			log.Printf("[%s] bad registration message format: user connect!\n", c.id)
-			return
-		}
-
-		// 判断是否广播上线消息，一个客户端上线只广播一次消息
-		isSendOnlineMsg := false
+	if spec.ServerOnly {
+		log.Printf("[%s] Act %s can only be sent by server, discard message.\n", c.id, spec.Act)
+		c.notice(spec.Act, NewError(ErrCodeUnauthorizedAct, "act %s can only be sent by server", spec.Act))
+		return
+	}
 
-		// 注册时间只在第一次注册时设置
-		if !c.isRegistered {
-			switch v := c.info.(type) {
-			case *UserInfo:
-				v.Vi = message.Vi
-				v.Hw = message.Hw
-				if message.Os != "" {
-					v.Os = message.Os
-				}
-			case *DeviceInfo:
-				v.Vi = message.Vi
-				v.Hw = message.Hw
-				if message.Dt != "" {
-					v.Dt = message.Dt
-				}
-			}
+	if !c.permitted(spec) {
+		log.Printf("[%s] Role %s is not permitted to send act %s, discard message.\n", c.id, c.role(), spec.Act)
+		c.notice(spec.Act, NewError(ErrCodeUnauthorizedAct, "role %s is not permitted to send act %s", c.role(), spec.Act))
+		return
+	}
 
-			c.isRegistered = true
-			c.registeredAt = time.Now().UnixNano()
-			// 是否发送上线消息
-			isSendOnlineMsg = true
-			// 用户注册到Hub
-			c.hub.register <- c
-			// 退出registration countdown goroutine
-			close(c.stopreg)
+	if err := c.rateLimit(spec.Act); err != nil {
+		log.Printf("[%s] %s, discard message.\n", c.id, err)
+		if c.strike() {
+			c.setClose(closeRateLimited, "rate limited")
+			c.logout(spec.Act, err)
+			return
 		}
+		c.notice(spec.Act, err)
+		return
+	}
 
-		// 推送上线消息
-		if isSendOnlineMsg {
-			if c.isUser() {
-				userInfo := c.info.(*UserInfo)
-				instruction := &UsrOnlineMsg{
-					Act:    "8",
-					Uid:    c.id,
-					Nm:     userInfo.Nickname,
-					Sex:    strconv.Itoa(c.info.(*UserInfo).Sex),
-					Idt:    strconv.Itoa(c.identity),
-					Os:     userInfo.Os,
-					Vi:     userInfo.Vi,
-					Hw:     userInfo.Hw,
-					Sender: c.id,
-					Unit:   c.unitId,
-				}
-				c.hub.inbound <- instruction
-			} else if c.isDevice() {
-				deviceInfo := c.info.(*DeviceInfo)
-				instruction := &DevOnlineMsg{
-					Act:    "10",
-					Did:    c.id,
-					Nm:     c.id,
-					Dt:     deviceInfo.Dt,
-					Vi:     deviceInfo.Vi,
-					Hw:     deviceInfo.Hw,
-					Sender: c.id,
-					Unit:   c.unitId,
-				}
-				c.hub.inbound <- instruction
-			}
+	var flagged []string
+	filterStep := func(c *Client, m Message) (err error) {
+		flagged, err = filterContent(c, m)
+		return err
+	}
+	for _, step := range []func(*Client, Message) error{spec.Validate, filterStep, spec.Handle, spec.Persist} {
+		if step == nil {
+			continue
 		}
-	case *LocalRegMsg:
-		// "本地注册消息"只能由"本地中控"发送
-		if c.isLocalControl() {
-			if message.Act == "2" {
-				// 新增本地终端
-				for _, item := range message.Usr {
-					item.RegisteredAt = time.Now().Unix()
-					c.localUsers.Add(*item)
-					// 推送上线消息
-					instruction := &UsrOnlineMsg{
-						Act:    "8",
-						Uid:    item.Uid,
-						Nm:     item.Nm,
-						Sex:    item.Sex,
-						Idt:    item.Idt,
-						Os:     item.Os,
-						Vi:     item.Vi,
-						Hw:     item.Hw,
-						Sender: c.id,
-						Unit:   c.unitId,
-					}
-					c.hub.inbound <- instruction
-				}
-				for _, item := range message.Dev {
-					item.RegisteredAt = time.Now().Unix()
-					c.localDevices.Add(*item)
-					// 推送上线消息
-					instruction := &DevOnlineMsg{
-						Act:    "10",
-						Did:    item.Did,
-						Nm:     item.Did,
-						Dt:     item.Dt,
-						Vi:     item.Vi,
-						Hw:     item.Hw,
-						Sender: c.id,
-						Unit:   c.unitId,
-					}
-					c.hub.inbound <- instruction
-				}
-			} else if message.Act == "3" {
-				// 清空已有本地终端，将消息体里的终端作为新的终端
-				c.localUsers = new(LocalUserSet)
-				c.localDevices = new(LocalDeviceSet)
-				for _, item := range message.Usr {
-					item.RegisteredAt = time.Now().Unix()
-					c.localUsers.Add(*item)
-					// 推送上线消息
-					instruction := &UsrOnlineMsg{
-						Act:    "8",
-						Uid:    item.Uid,
-						Nm:     item.Nm,
-						Sex:    item.Sex,
-						Idt:    item.Idt,
-						Os:     item.Os,
-						Vi:     item.Vi,
-						Hw:     item.Hw,
-						Sender: c.id,
-						Unit:   c.unitId,
-					}
-					c.hub.inbound <- instruction
-				}
-				for _, item := range message.Dev {
-					item.RegisteredAt = time.Now().Unix()
-					c.localDevices.Add(*item)
-					// 推送上线消息
-					instruction := &DevOnlineMsg{
-						Act:    "10",
-						Did:    item.Did,
-						Nm:     item.Did,
-						Dt:     item.Dt,
-						Vi:     item.Vi,
-						Hw:     item.Hw,
-						Sender: c.id,
-						Unit:   c.unitId,
-					}
-					c.hub.inbound <- instruction
-				}
+		if err := step(c, message); err != nil {
+			if err != ErrDiscard {
+				log.Printf("[%s] %s\n", c.id, err)
+				c.notice(spec.Act, err)
 			}
-		} else {
-			log.Printf("[%s] Not local control, discard message.\n", c.id)
-			return
-		}
-	case *OrdinaryMsg:
-		if message.To == "" {
-			log.Printf("[%s] No field 'to', discard message.\n")
-			c.notice("No field 'to', discard message.")
-			return
-		}
-		message.Sender = c.id
-		message.Unit = c.unitId
-		c.hub.inbound <- message
-	case *ModStatusMsg:
-		if message.To == "" {
-			log.Printf("[%s] No field 'to', discard message.\n", c.id)
-			c.notice("No field 'to', discard message.")
 			return
 		}
+	}
 
-		// 获取当前单元模块
-		if message.Mod != "" {
-			c.unitInfo.Curmod = message.Mod
-		}
+	if spec.Receivers != RecvNone {
+		c.hub.dispatch(message)
+	}
+	c.flagContent(message, flagged)
+}
 
-		// 记录状态指令历史
-		message.CreatedAt = time.Now().Unix()
-		storeData, _ := json.Marshal(message)
-		modInsHisKey := fmt.Sprintf(modInsHistoryKeyFormat, c.unitId, c.unitInfo.SceneId, c.unitInfo.Curmod)
-		if _, err = c.redconn.Do("RPUSH", modInsHisKey, string(storeData)); err != nil {
-			c.notice("Failed to rpush " + modInsHisKey)
-			c.logout("Failed to rpush " + modInsHisKey)
-			return
-		}
-		log.Printf("[%s] RPUSH %s %s", c.id, modInsHisKey, string(storeData))
+func init() {
+	RegisterAct(&ActSpec{Act: "1", New: func() Message { return new(RegMsg) }, Handle: handleReg})
+	RegisterAct(&ActSpec{Act: "2", New: func() Message { return new(LocalRegMsg) }, Handle: handleLocalReg})
+	// Act=3与Act=2消息格式相同，按act区分
+	RegisterAct(&ActSpec{Act: "3", New: func() Message { return new(LocalRegMsg) }, Handle: handleLocalReg})
+	RegisterAct(&ActSpec{
+		Act:       "6",
+		New:       func() Message { return new(OrdinaryMsg) },
+		Validate:  validateTo,
+		Receivers: RecvTo,
+	})
+	RegisterAct(&ActSpec{
+		Act:       "7",
+		New:       func() Message { return new(ModStatusMsg) },
+		Roles:     []string{RoleTeacher, RoleDevice, RoleLocalControl},
+		Validate:  validateTo,
+		Handle:    handleModStatus,
+		Persist:   persistModStatus,
+		Receivers: RecvTo,
+	})
+	RegisterAct(&ActSpec{Act: "8", New: func() Message { return new(UsrOnlineMsg) }, ServerOnly: true, Receivers: RecvUnit})
+	RegisterAct(&ActSpec{Act: "9", New: func() Message { return new(UsrOfflineMsg) }, Handle: handleUsrOffline, Receivers: RecvUnit})
+	RegisterAct(&ActSpec{Act: "10", New: func() Message { return new(DevOnlineMsg) }, ServerOnly: true, Receivers: RecvUnit})
+	RegisterAct(&ActSpec{Act: "11", New: func() Message { return new(DevOfflineMsg) }, Handle: handleDevOffline, Receivers: RecvUnit})
+	RegisterAct(&ActSpec{
+		Act:       "12",
+		New:       func() Message { return new(UnitControlMsg) },
+		Roles:     []string{RoleTeacher, RoleLocalControl},
+		Handle:    handleUnitControl,
+		Receivers: RecvUnit,
+	})
+	RegisterAct(&ActSpec{Act: "13", New: func() Message { return new(PullInkMsg) }, Handle: handlePullInk})
+	RegisterAct(&ActSpec{Act: "14", New: func() Message { return new(EndPullInkMsg) }, Handle: handleEndPullInk})
+	RegisterAct(&ActSpec{
+		Act:       "15",
+		New:       func() Message { return new(ChatTextMsg) },
+		Validate:  validateChatText,
+		Handle:    handleChatText,
+		Persist:   persistChatText,
+		Receivers: RecvTo,
+	})
+	RegisterAct(&ActSpec{Act: "17", New: func() Message { return new(LocalEnvelopeMsg) }, ServerOnly: true})
+	RegisterAct(&ActSpec{Act: "18", New: func() Message { return new(SysNoticeMsg) }, ServerOnly: true, Receivers: RecvUnit})
+	RegisterAct(&ActSpec{Act: "19", New: func() Message { return new(ChatRecallMsg) }, Handle: handleChatRecall, Receivers: RecvTo})
+	RegisterAct(&ActSpec{
+		Act:       "20",
+		New:       func() Message { return new(ChatMuteMsg) },
+		Roles:     []string{RoleTeacher},
+		Handle:    handleChatMute,
+		Receivers: RecvUnit,
+	})
+	RegisterAct(&ActSpec{Act: "21", New: func() Message { return new(ContentFlagMsg) }, ServerOnly: true, Receivers: RecvTo})
+	RegisterAct(&ActSpec{Act: "22", New: func() Message { return new(SyncMsg) }, ServerOnly: true})
+}
 
-		// 更新当前单元模块状态
-		modInsKey := fmt.Sprintf(modInsKeyFormat, c.unitId, c.unitInfo.SceneId)
-		ret, err := redis.Bytes(c.redconn.Do("HGET", modInsKey, c.unitInfo.Curmod))
-		if err != nil && err != redis.ErrNil {
-			log.Printf("[%s] Failed to hget %s, error: %s\n", c.id, modInsKey, err)
-			c.logout("Failed to hget " + modInsKey)
-			return
+// 校验to字段，语法错误返回给客户端
+func validateTo(c *Client, message Message) error {
+	to := message.(Addressed).GetTo()
+	if to == "" {
+		return NewError(ErrCodeMissingTo, "No field 'to', discard message.")
+	}
+	if _, err := ParseToInUnit(to, c.unitInfo); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 注册消息Act=1
+func handleReg(c *Client, m Message) error {
+	message := m.(*RegMsg)
+	// 判断注册消息是否和客户端身份匹配
+	if (c.isDevice() && message.Dt == "") || (c.isUser() && message.Dt != "") {
+		return NewError(ErrCodeBadRegistration, "bad registration message format")
+	}
+
+	// 注册时间只在第一次注册时设置，一个客户端上线只广播一次消息
+	if c.isRegistered {
+		return nil
+	}
+	switch v := c.info.(type) {
+	case *UserInfo:
+		v.Vi = message.Vi
+		v.Hw = message.Hw
+		if message.Os != "" {
+			v.Os = message.Os
 		}
-		// log.Printf("debug........... %#v, %#v\n", string(ret), err)
+	case *DeviceInfo:
+		v.Vi = message.Vi
+		v.Hw = message.Hw
+		if message.Dt != "" {
+			v.Dt = message.Dt
+		}
+	}
 
-		if ret == nil {
-			if message.Mod == "" || message.To == "" {
-				log.Printf("[%s] Field 'mod' or 'to' not exists, can't be init, discard the instruction.\n", c.id)
-				c.notice("Field 'mod' or 'to' not exists, can't be init, discard the instruction.")
-				return
-			}
+	c.hub.setRegistered(c)
+	// 用户注册到Hub
+	c.hub.register <- c
+	// 退出registration countdown goroutine
+	close(c.stopreg)
+	// 写入在线记录
+	c.hub.setOnline(c)
 
-			message.UpdatedAt = time.Now().Unix()
-			storeData, _ = json.Marshal(message)
-			if _, err := c.redconn.Do("HSET", modInsKey, c.unitInfo.Curmod, storeData); err != nil {
-				log.Printf("[%s] Failed to hset %s, error: %s\n", c.id, modInsKey, err)
-				c.logout("Failed to hset " + modInsKey)
-				return
-			}
-			log.Printf("[%s] HSET %s %s %s", c.id, modInsKey, c.unitInfo.Curmod, storeData)
-		} else {
-			incrmsg, ok := message.Msg.(map[string]interface{})
-			if !ok {
-				log.Printf("[%s] field 'msg' not exists, discard the instruction\n", c.id)
-				c.notice("field 'msg' not exists, discard the instruction")
-				return
-			}
+	// 推送同步消息，晚加入或重连的客户端无需再查询当前状态
+	c.syncPending = true
 
-			var curstat ModStatusMsg
-			if err := json.Unmarshal(ret, &curstat); err != nil {
-				log.Printf("[%s] Failed to json.Marshal: %s\n", c.id, err)
-				c.notice("Json format error")
-				return
-			}
+	// 宽限期内重连，不推送上线消息
+	if o := c.hub.cancelOffline(c); o != nil {
+		if c.isLocalControl() {
+			c.carryLocals(o.locals)
+		}
+		return nil
+	}
 
-			curstat.UpdatedAt = time.Now().Unix()
-			curstat.To = message.To
+	// 推送上线消息
+	if c.isUser() {
+		userInfo := c.info.(*UserInfo)
+		c.hub.dispatch(&UsrOnlineMsg{
+			Act:   "8",
+			Uid:   c.id,
+			Nm:    userInfo.Nickname,
+			Sex:   strconv.Itoa(userInfo.Sex),
+			Idt:   strconv.Itoa(c.identity),
+			Os:    userInfo.Os,
+			Vi:    userInfo.Vi,
+			Hw:    userInfo.Hw,
+			Route: message.Route,
+		})
+	} else if c.isDevice() {
+		deviceInfo := c.info.(*DeviceInfo)
+		c.hub.dispatch(&DevOnlineMsg{
+			Act:   "10",
+			Did:   c.id,
+			Nm:    c.id,
+			Dt:    deviceInfo.Dt,
+			Vi:    deviceInfo.Vi,
+			Hw:    deviceInfo.Hw,
+			Route: message.Route,
+		})
+	}
+	return nil
+}
 
-			currmsg, ok := curstat.Msg.(map[string]interface{})
-			if !ok || (incrmsg["nm"] != nil && incrmsg["nm"] != currmsg["nm"]) {
-				curstat.Msg = message.Msg
-			} else {
-				for k, v := range incrmsg {
-					currmsg[k] = v
-				}
-				curstat.Msg = currmsg
-			}
+// 本地注册消息Act=2(新增本地终端)，Act=3(清空已有本地终端，将消息体里的终端作为新的终端)
+func handleLocalReg(c *Client, m Message) error {
+	message := m.(*LocalRegMsg)
+	// "本地注册消息"只能由"本地中控"发送
+	if !c.isLocalControl() {
+		return NewError(ErrCodeUnauthorizedAct, "Not local control, discard message.")
+	}
 
-			storeData, _ = json.Marshal(curstat)
-			if _, err := c.redconn.Do("HSET", modInsKey, c.unitInfo.Curmod, storeData); err != nil {
-				log.Printf("[%s] Failed to hset %s, error: %s\n", c.id, modInsKey, err)
-				c.logout("Failed to hset " + modInsKey)
-				return
-			}
-			log.Printf("[%s] HSET %s %s %s\n", c.id, modInsKey, c.unitInfo.Curmod, storeData)
-		}
+	// 本地终端加入单元分类缓存，消息经由本地中控转发
+	room := c.hub.room(c.unitId)
+	if room == nil {
+		return NewError(ErrCodeNotRegistered, "Not registered, discard message.")
+	}
 
-		message.Sender = c.id
-		message.Unit = c.unitId
-		c.hub.inbound <- message
-	case *UsrOnlineMsg:
-	case *UsrOfflineMsg:
-		if message.Uid == c.id {
-			c.logout("Terminate client")
-		} else {
-			if c.isLocalControl() {
-				c.localUsers.Remove(message.Uid)
-			}
+	if message.Act == "3" {
+		c.localUsers.Clear()
+		c.localDevices.Clear()
+		room.clearLocal(c)
+	}
+	for _, item := range message.Usr {
+		item.RegisteredAt = time.Now().Unix()
+		c.localUsers.Add(*item)
+		room.addLocalUser(c, item)
+		// 重连前已上报过，不再推送上线消息
+		if c.uncarry(item.Uid) {
+			continue
 		}
-		// 广播下线通知
-		message.Sender = c.id
-		message.Unit = c.unitId
-		c.hub.inbound <- message
-	case *DevOnlineMsg:
-	case *DevOfflineMsg:
-		if message.Did == c.id {
-			c.logout("Terminate client")
-		} else {
-			if c.isLocalControl() {
-				c.localDevices.Remove(message.Did)
-			}
+		// 推送上线消息
+		c.hub.dispatch(&UsrOnlineMsg{
+			Act:   "8",
+			Uid:   item.Uid,
+			Nm:    item.Nm,
+			Sex:   item.Sex,
+			Idt:   item.Idt,
+			Os:    item.Os,
+			Vi:    item.Vi,
+			Hw:    item.Hw,
+			Route: message.Route,
+		})
+	}
+	for _, item := range message.Dev {
+		item.RegisteredAt = time.Now().Unix()
+		c.localDevices.Add(*item)
+		room.addLocalDevice(c, item)
+		if c.uncarry(item.Did) {
+			continue
 		}
+		// 推送上线消息
+		c.hub.dispatch(&DevOnlineMsg{
+			Act:   "10",
+			Did:   item.Did,
+			Nm:    item.Did,
+			Dt:    item.Dt,
+			Vi:    item.Vi,
+			Hw:    item.Hw,
+			Route: message.Route,
+		})
+	}
+	c.hub.setLocalOnlines(c)
+	return nil
+}
 
-		// 广播下线通知
-		message.Sender = c.id
-		message.Unit = c.unitId
-		c.hub.inbound <- message
-	case *UnitControlMsg:
-		stat := message.Msg.(map[string]interface{})["stat"]
-		if stat == "1" {
-			// 开始课程
-			sceneInfo := map[string]interface{}{
-				"unit_id":    c.unitId,
-				"scene_id":   c.unitInfo.SceneId,
-				"start_time": time.Now().Unix(),
-			}
-			b, err := json.Marshal(sceneInfo)
-			if err != nil {
-				c.logout(err.Error())
-				return
-			}
-			sceneKey := fmt.Sprintf(sceneKeyFormat, c.unitId, c.unitInfo.SceneId)
-			if _, err := c.redconn.Do("SET", sceneKey, string(b)); err != nil {
-				c.logout(err.Error())
-				return
-			}
-			c.log(fmt.Sprintf("SET %s %s", sceneKey, string(b)))
-			log.Printf("[%s] SET %s %s\n", c.id, sceneKey, string(b))
-		} else if stat == "2" {
-			// TODO 结束单元逻辑
-			// 记录单元场景结束时间
-			sceneKey := fmt.Sprintf(sceneKeyFormat, c.unitId, c.unitInfo.SceneId)
-			res, err := redis.Bytes(c.redconn.Do("GET", sceneKey))
-			if err != nil && err != redis.ErrNil {
-				c.logout(err.Error())
-				return
-			}
-			sceneInfo := make(map[string]interface{})
-			if res == nil {
-				sceneInfo = map[string]interface{}{
-					"unit_id":  c.unitId,
-					"scene_id": c.unitInfo.SceneId,
-					"end_time": time.Now().Unix(),
-				}
-			} else {
-				if err := json.Unmarshal(res, &sceneInfo); err != nil {
-					c.logout(err.Error())
-					return
-				}
-				sceneInfo["end_time"] = time.Now().Unix()
-			}
-			b, err := json.Marshal(sceneInfo)
-			if err != nil {
-				c.logout(err.Error())
-				return
-			}
-			if _, err := c.redconn.Do("SET", sceneKey, string(b)); err != nil {
-				c.logout(err.Error())
-				return
-			}
-			c.log(fmt.Sprintf("SET %s %s", sceneKey, string(b)))
-			log.Printf("[%s] SET %s %s\n", c.id, sceneKey, string(b))
-
-			// 自增场景id
-			sceneIdKey := fmt.Sprintf(sceneIdKeyFormat, c.unitId)
-			if _, err := c.redconn.Do("INCR", sceneIdKey); err != nil {
-				c.logout(err.Error())
-				return
-			}
-			log.Printf("[%s] INCR %s\n", c.id, sceneIdKey)
+// 用户下线消息Act=9
+func handleUsrOffline(c *Client, m Message) error {
+	message := m.(*UsrOfflineMsg)
+	if message.Uid == c.id {
+		// 主动下线，本条消息即为下线通知
+		c.leave()
+		c.logout(message.Act, ErrTerminated)
+	} else if c.isLocalControl() {
+		c.localUsers.Remove(message.Uid)
+		if room := c.hub.room(c.unitId); room != nil {
+			room.removeLocal(c, message.Uid)
+		}
+		c.hub.setLocalOffline(c, message.Uid)
+	}
+	return nil
+}
 
-			// 结束课程
-			c.logout("Terminate, end course")
-			return
+// 设备下线消息Act=11
+func handleDevOffline(c *Client, m Message) error {
+	message := m.(*DevOfflineMsg)
+	if message.Did == c.id {
+		// 主动下线，本条消息即为下线通知
+		c.leave()
+		c.logout(message.Act, ErrTerminated)
+	} else if c.isLocalControl() {
+		c.localDevices.Remove(message.Did)
+		if room := c.hub.room(c.unitId); room != nil {
+			room.removeLocal(c, message.Did)
 		}
-		// 广播课程状态消息
-		message.Sender = c.id
-		message.Unit = c.unitId
-		c.hub.inbound <- message
-	case *PullInkMsg:
-		message.Sender = c.id
-		message.Unit = c.unitId
-		c.hub.inbound <- message
-	case *EndPullInkMsg:
-		message.Sender = c.id
-		message.Unit = c.unitId
-		c.hub.inbound <- message
-	case *ChatTextMsg:
-		text := message.Msg.(map[string]interface{})["c"].(string)
-		if len(text) > 100 {
-			c.notice("chat message too long")
-			return
+		c.hub.setLocalOffline(c, message.Did)
+	}
+	return nil
+}
+
+// 单元控制消息Act=12
+func handleUnitControl(c *Client, m Message) error {
+	message := m.(*UnitControlMsg)
+	msg, _ := message.Msg.(map[string]interface{})
+	stat := msg["stat"]
+	if stat == "1" {
+		// 开始课程
+		sceneInfo := map[string]interface{}{
+			"unit_id":    c.unitId,
+			"scene_id":   c.unitInfo.SceneId,
+			"start_time": time.Now().Unix(),
 		}
-		// 广播文字聊天消息
-		message.CreatedAt = time.Now().Unix()
-		message.Sender = c.id
-		message.Unit = c.unitId
-		c.hub.inbound <- message
-		// 持久化文字聊天消息
-		storedMsg, err := json.Marshal(message)
+		b, err := json.Marshal(sceneInfo)
 		if err != nil {
-			log.Printf("[%s] Failed to json.Marshal: %s\n", c.id, err)
-			c.notice("Json format error")
-			return
+			c.logout(message.Act, storageError(err))
+			return ErrDiscard
 		}
-		chatKey := fmt.Sprintf(chatKeyFormat, c.unitId, c.unitInfo.SceneId)
-		if _, err := c.redconn.Do("RPUSH", chatKey, string(storedMsg)); err != nil {
-			log.Printf("[%s] Failed to RPUSH chat message\n", c.id)
-			c.notice("Failed to RPUSH chat message")
+		sceneKey := fmt.Sprintf(sceneKeyFormat, c.unitId, c.unitInfo.SceneId)
+		if _, err := c.redconn.Do("SET", sceneKey, string(b)); err != nil {
+			c.logout(message.Act, storageError(err))
+			return ErrDiscard
+		}
+		c.log(fmt.Sprintf("SET %s %s", sceneKey, string(b)))
+		log.Printf("[%s] SET %s %s\n", c.id, sceneKey, string(b))
+	} else if stat == "2" {
+		// 结束课程：记录场景结束时间，自增场景id，通知并断开单元所有客户端
+		if err := c.hub.EndUnit(c.unitId, c.unitInfo.SceneId); err != nil {
+			return err
+		}
+		return ErrDiscard
+	}
+	return nil
+}
+
+// 开始拉取笔迹Act=13，笔迹流由Room按订阅转发
+func handlePullInk(c *Client, m Message) error {
+	message := m.(*PullInkMsg)
+	c.pullInk(message.Get)
+	log.Printf("[%s] Pull ink: %s\n", c.id, message.Get)
+	return nil
+}
+
+// 停止拉取笔迹Act=14
+func handleEndPullInk(c *Client, m Message) error {
+	message := m.(*EndPullInkMsg)
+	c.endPullInk(message.Get)
+	log.Printf("[%s] End pull ink: %s\n", c.id, message.Get)
+	return nil
+}
+
+// 笔迹流消息处理器：解析二进制帧，追加到笔迹流队列，并转发给拉取该笔迹的客户端
+func (c *Client) processPms(raw []byte) {
+	if !c.isRegistered {
+		log.Printf("[%s] Not registered, discard ink frame.\n", c.id)
+		c.notice("", NewError(ErrCodeNotRegistered, "Not registered, discard ink frame."))
+		return
+	}
+
+	if err := c.rateLimit(inkLimitKey); err != nil {
+		log.Printf("[%s] %s, discard ink frame.\n", c.id, err)
+		if c.strike() {
+			c.setClose(closeRateLimited, "rate limited")
+			c.logout("", err)
 			return
 		}
-		log.Printf("[%s] RPUSH %s %s\n", c.id, chatKey, string(storedMsg))
-	default:
+		c.notice("", err)
+		return
+	}
+
+	message, err := UnmarshalPacket(raw)
+	if err != nil {
+		log.Printf("[%s] %s\n", c.id, err)
+		c.notice("", NewError(ErrCodeBadInk, "%s", err))
+		return
+	}
+	// 只能发送自己的笔迹，本地中控可转发其上报的本地终端的笔迹
+	if !c.inkOwner(message.Uid) {
+		log.Printf("[%s] Ink frame of %s not owned by sender, discard.\n", c.id, message.Uid)
+		c.notice("", NewError(ErrCodeUnauthorizedAct, "ink frame of %s is not owned by sender", message.Uid))
+		return
 	}
+	message.Sender = c.id
+	message.Unit = c.unitId
+	message.Scene = c.unitInfo.SceneId
 
-	return
+	// 持久化笔迹流，由cmd/persistent_pms.go写入文件
+	pmsKey := fmt.Sprintf(pmsKeyFormat, c.unitId, c.unitInfo.SceneId, message.Uid)
+	n, err := redis.Int64(c.redconn.Do("RPUSH", pmsKey, raw))
+	if err != nil {
+		log.Printf("[%s] Failed to RPUSH %s, error: %s\n", c.id, pmsKey, err)
+		c.notice("", storageError(err))
+		return
+	}
+	c.markInk(message.Uid, n-1)
+
+	c.hub.dispatchPms(message)
+}
+
+// 客户端是否可以发送uid的笔迹：本人，或本地中控上报的本地终端
+func (c *Client) inkOwner(uid string) bool {
+	if uid == c.id {
+		return true
+	}
+	if !c.isLocalControl() {
+		return false
+	}
+	if _, ok := c.localUsers.Get(uid); ok {
+		return true
+	}
+	_, ok := c.localDevices.Get(uid)
+	return ok
 }
@@ -0,0 +1,35 @@
+package ndscloud
+
+import "testing"
+
+func TestInkOwner(t *testing.T) {
+	s1 := newTestClient(nil, "u1", "101", nil, 0)
+	s1.localUsers = NewLocalUserSet()
+	s1.localDevices = NewLocalDeviceSet()
+	nds := newTestClient(nil, "u1", "n1", nil, 0)
+	nds.info = &DeviceInfo{ClientId: "n1", Dt: "1"}
+	nds.localUsers = NewLocalUserSet()
+	nds.localDevices = NewLocalDeviceSet()
+	nds.localUsers.Add(LocalUsrRegItem{Uid: "201"})
+	nds.localDevices.Add(LocalDevRegItem{Did: "301"})
+
+	cases := []struct {
+		c    *Client
+		uid  string
+		want bool
+	}{
+		{c: s1, uid: "101", want: true},
+		{c: s1, uid: "102", want: false},
+		// 非本地中控不能转发本地终端的笔迹
+		{c: s1, uid: "201", want: false},
+		{c: nds, uid: "n1", want: true},
+		{c: nds, uid: "201", want: true},
+		{c: nds, uid: "301", want: true},
+		{c: nds, uid: "101", want: false},
+	}
+	for _, c := range cases {
+		if got := c.c.inkOwner(c.uid); got != c.want {
+			t.Errorf("%s sending ink of %s: got %t, want %t", c.c.id, c.uid, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package ndscloud
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+)
+
+// 限流：按act的令牌桶，分别限制每个客户端及每个单元(本节点)的发送速率，如
+//
+//	[Cc.RateLimits.15]
+//	Rate = 2        # 每个客户端每秒
+//	Burst = 5
+//	UnitRate = 50   # 每个单元每秒
+//	UnitBurst = 100
+//
+// "*"限制所有act的总速率，未配置时每个客户端每秒50条(突发100)。
+// "ink"限制笔迹帧(不计入"*")，未配置时每个客户端每秒100帧(突发200)。
+// 超限的消息回复ErrCodeRateLimited并丢弃；一分钟内超限Cc.RateLimitStrikes次(默认20)的客户端将被断开。
+
+const (
+	defaultClientRate  = 50
+	defaultClientBurst = 100
+	defaultInkRate     = 100
+	defaultInkBurst    = 200
+	defaultStrikes     = 20
+	strikeWindow       = time.Minute
+
+	// 笔迹帧的令牌桶
+	inkLimitKey = "ink"
+	// 记录超限次数的令牌桶
+	strikeKey = "!strike"
+)
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// 一组令牌桶，零值可用
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// rate<=0表示不限制
+func (l *rateLimiter) allow(key string, rate float64, burst int, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(rate, burst, now)
+		l.buckets[key] = b
+	}
+	return b.allow(now)
+}
+
+func rateLimitOf(act string) config.RateLimit {
+	limit, ok := config.Config.Cc.RateLimits[act]
+	if !ok && act == "*" {
+		limit = config.RateLimit{Rate: defaultClientRate, Burst: defaultClientBurst}
+	}
+	if !ok && act == inkLimitKey {
+		limit = config.RateLimit{Rate: defaultInkRate, Burst: defaultInkBurst}
+	}
+	return limit
+}
+
+// 检查客户端发送该act是否超限，笔迹帧(inkLimitKey)不计入"*"
+func (c *Client) rateLimit(act string) error {
+	now := time.Now()
+	room := c.hub.room(c.unitId)
+	keys := []string{"*", act}
+	if act == inkLimitKey {
+		keys = keys[1:]
+	}
+	for _, key := range keys {
+		limit := rateLimitOf(key)
+		if !c.limits.allow(key, limit.Rate, limit.Burst, now) {
+			return NewError(ErrCodeRateLimited, "rate limit exceeded for act %s", act)
+		}
+		if room != nil && !room.limits.allow(key, limit.UnitRate, limit.UnitBurst, now) {
+			return NewError(ErrCodeRateLimited, "unit rate limit exceeded for act %s", act)
+		}
+	}
+	return nil
+}
+
+// 记录一次超限，超限过于频繁时返回true
+func (c *Client) strike() bool {
+	strikes := config.Config.Cc.RateLimitStrikes
+	if strikes == 0 {
+		strikes = defaultStrikes
+	}
+	if strikes < 0 {
+		return false
+	}
+	if c.limits.allow(strikeKey, float64(strikes)/strikeWindow.Seconds(), strikes, time.Now()) {
+		return false
+	}
+	log.Printf("[%s] Rate limit exceeded %d times in %s, disconnect client.\n", c.id, strikes, strikeWindow)
+	return true
+}
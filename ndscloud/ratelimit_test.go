@@ -0,0 +1,170 @@
+package ndscloud
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newTokenBucket(2, 3, now)
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Fatalf("burst %d denied", i)
+		}
+	}
+	if b.allow(now) {
+		t.Errorf("allowed beyond burst")
+	}
+	// 每秒补充2个
+	if !b.allow(now.Add(500*time.Millisecond)) || b.allow(now.Add(500*time.Millisecond)) {
+		t.Errorf("refill after 500ms: want exactly one token")
+	}
+	// 补充不超过burst
+	later := now.Add(10 * time.Second)
+	n := 0
+	for b.allow(later) {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("refill after 10s: got %d tokens, want 3", n)
+	}
+
+	// 未指定burst时为rate向上取整
+	if b := newTokenBucket(2.5, 0, now); b.burst != 3 {
+		t.Errorf("default burst: got %v, want 3", b.burst)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var l rateLimiter
+	for i := 0; i < 100; i++ {
+		if !l.allow("a", 0, 0, now) {
+			t.Fatalf("rate 0 should not limit")
+		}
+	}
+	if !l.allow("a", 1, 1, now) || l.allow("a", 1, 1, now) {
+		t.Errorf("rate 1: want one token")
+	}
+	// 各key独立
+	if !l.allow("b", 1, 1, now) {
+		t.Errorf("key b limited by key a")
+	}
+}
+
+func TestRateLimitOf(t *testing.T) {
+	defer func(limits map[string]config.RateLimit) { config.Config.Cc.RateLimits = limits }(config.Config.Cc.RateLimits)
+
+	config.Config.Cc.RateLimits = nil
+	cases := map[string]config.RateLimit{
+		"*":         {Rate: defaultClientRate, Burst: defaultClientBurst},
+		inkLimitKey: {Rate: defaultInkRate, Burst: defaultInkBurst},
+		"15":        {},
+	}
+	for act, want := range cases {
+		if got := rateLimitOf(act); got != want {
+			t.Errorf("default %s: got %+v, want %+v", act, got, want)
+		}
+	}
+
+	config.Config.Cc.RateLimits = map[string]config.RateLimit{
+		"*":  {Rate: 5, Burst: 10},
+		"15": {Rate: 2, UnitRate: 50},
+	}
+	if got := rateLimitOf("*"); got.Rate != 5 || got.Burst != 10 {
+		t.Errorf("configured *: got %+v", got)
+	}
+	if got := rateLimitOf("15"); got.Rate != 2 || got.UnitRate != 50 {
+		t.Errorf("configured 15: got %+v", got)
+	}
+	if got := rateLimitOf("6"); got.Rate != 0 {
+		t.Errorf("unconfigured 6: got %+v", got)
+	}
+}
+
+func TestStrike(t *testing.T) {
+	defer func(strikes int) { config.Config.Cc.RateLimitStrikes = strikes }(config.Config.Cc.RateLimitStrikes)
+
+	config.Config.Cc.RateLimitStrikes = 3
+	c := newTestClient(nil, "u1", "s1", nil, 0)
+	for i := 0; i < 3; i++ {
+		if c.strike() {
+			t.Fatalf("strike %d disconnects", i+1)
+		}
+	}
+	if !c.strike() {
+		t.Errorf("strike 4 should disconnect")
+	}
+
+	config.Config.Cc.RateLimitStrikes = -1
+	c = newTestClient(nil, "u1", "s2", nil, 0)
+	for i := 0; i < 100; i++ {
+		if c.strike() {
+			t.Fatalf("strikes disabled but disconnected")
+		}
+	}
+}
+
+// 清空指令帧
+func inkClearFrame(uid uint64) []byte {
+	frame := []byte{0, 0, 0, 0, 0, 0, PmsActClear}
+	for i := 5; i >= 1; i-- {
+		frame[i] = byte(uid)
+		uid >>= 8
+	}
+	return frame
+}
+
+// 笔迹帧超限时丢弃，频繁超限时以4010断开
+func TestProcessPmsRateLimited(t *testing.T) {
+	defer func(limits map[string]config.RateLimit, strikes int) {
+		config.Config.Cc.RateLimits = limits
+		config.Config.Cc.RateLimitStrikes = strikes
+	}(config.Config.Cc.RateLimits, config.Config.Cc.RateLimitStrikes)
+	config.Config.Cc.RateLimits = map[string]config.RateLimit{
+		// 笔迹帧不受"*"限制
+		"*":         {Rate: 0.001, Burst: 1},
+		inkLimitKey: {Rate: 0.001, Burst: 2},
+	}
+	config.Config.Cc.RateLimitStrikes = 2
+
+	hub := NewHub()
+	r := newFakeRedis()
+	c := newTestClient(hub, "u1", "101", nil, 0)
+	c.redconn = r
+	hub.add(c)
+	defer hub.removebyunitid("u1")
+	unregistered := make(chan *Client, 1)
+	go func() { unregistered <- <-hub.unregister }()
+
+	pmsKey := fmt.Sprintf(pmsKeyFormat, "u1", 1, "101")
+	for i := 0; i < 4; i++ {
+		c.processPms(inkClearFrame(101))
+	}
+	if n := len(r.lists[pmsKey]); n != 2 {
+		t.Errorf("got %d frames stored, want 2", n)
+	}
+	if code, _ := c.getClose(); code != 0 {
+		t.Errorf("closed with %d before strikes exhausted", code)
+	}
+
+	c.processPms(inkClearFrame(101))
+	if code, _ := c.getClose(); code != closeRateLimited {
+		t.Errorf("got close code %d, want %d", code, closeRateLimited)
+	}
+	select {
+	case got := <-unregistered:
+		if got != c {
+			t.Errorf("unregistered another client")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("client not unregistered")
+	}
+	if n := len(r.lists[pmsKey]); n != 2 {
+		t.Errorf("got %d frames stored, want 2", n)
+	}
+}
@@ -2,6 +2,7 @@ package ndscloud
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/darling-kefan/xj/config"
 	"github.com/gomodule/redigo/redis"
@@ -25,6 +26,42 @@ var (
 	// 群聊(文字聊天)(list)
 	// fmt.Sprintf(this, unitId, sceneId)
 	chatKeyFormat string = "nc:chat:his:%s:%d"
+	// 聊天禁言(hash: uid|* -> 禁言时间)
+	// fmt.Sprintf(this, unitId, sceneId)
+	chatMuteKeyFormat string = "nc:chat:mute:%s:%d"
+
+	// 笔迹流(list)，由cmd/persistent_pms.go持久化到文件
+	// fmt.Sprintf(this, unitId, sceneId, uid)
+	pmsKeyFormat string = "nc:pms:%s:%d:%s"
+	// 笔迹段标记(list)，见timeline.go。不使用nc:pms:前缀，避免与笔迹流的key混淆
+	// fmt.Sprintf(this, unitId, sceneId)
+	inkSegmentKeyFormat string = "nc:ink:seg:%s:%d"
+	// 有笔迹的终端(set)，记录笔迹段时写入
+	// fmt.Sprintf(this, unitId, sceneId)
+	inkUsersKeyFormat string = "nc:ink:users:%s:%d"
+
+	// 单元消息编号(kv)
+	// fmt.Sprintf(this, unitId)
+	seqKeyFormat string = "nc:seq:%s"
+	// 单元消息补发缓冲区(stream)
+	// fmt.Sprintf(this, unitId)
+	replayKeyFormat string = "nc:replay:%s"
+
+	// 集群消息频道(pub/sub)
+	clusterChannel string = "nc:cluster:bus"
+	// 集群请求应答(list)
+	// fmt.Sprintf(this, node, seq)
+	clusterReplyKeyFormat string = "nc:cluster:reply:%s:%d"
+
+	// 单元在线终端(hash: id -> json)，由ping/pong续期
+	// fmt.Sprintf(this, unitId)
+	onlinesKeyFormat string = "nc:onlines:%s"
+	// 本地中控上报的本地终端(hash: id -> json)，随本地中控续期
+	// fmt.Sprintf(this, unitId, localControlId)
+	localOnlinesKeyFormat string = "nc:onlines:lc:%s:%s"
+
+	// 结束单元信号频道(pub/sub)，消息为"{unitId}:{sceneId}"或"{unitId}"
+	endUnitChannel string = "nc:unit:end"
 )
 
 // 创建Redis连接
@@ -47,3 +84,12 @@ func connectRedis() (redis.Conn, error) {
 	}
 	return conn, nil
 }
+
+// 创建Redis连接池
+func newRedisPool() *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 240 * time.Second,
+		Dial:        connectRedis,
+	}
+}
@@ -0,0 +1,242 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 内存redis，只支持测试用到的命令；MULTI之后Send的命令在EXEC时执行
+type fakeRedis struct {
+	strings map[string]string
+	hashes  map[string]map[string]string
+	lists   map[string][]string
+	sets    map[string]map[string]struct{}
+
+	multi  bool
+	queued [][]interface{}
+	// 之后n次EXEC返回nil，模拟WATCH的key被其它连接修改
+	conflicts int
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		strings: make(map[string]string),
+		hashes:  make(map[string]map[string]string),
+		lists:   make(map[string][]string),
+		sets:    make(map[string]map[string]struct{}),
+	}
+}
+
+func (r *fakeRedis) rpush(key string, v interface{}) {
+	b, _ := json.Marshal(v)
+	r.lists[key] = append(r.lists[key], string(b))
+}
+
+func fakeArg(arg interface{}) string {
+	switch v := arg.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(arg)
+}
+
+func fakeIndex(arg interface{}) int {
+	n, _ := strconv.Atoi(fakeArg(arg))
+	return n
+}
+
+func (r *fakeRedis) Do(cmd string, args ...interface{}) (interface{}, error) {
+	cmd = strings.ToUpper(cmd)
+	switch cmd {
+	case "":
+		// 连接池归还连接时的flush
+		return nil, nil
+	case "WATCH", "UNWATCH":
+		return "OK", nil
+	case "EVALSHA":
+		script, ok := fakeScripts[fakeArg(args[0])]
+		if !ok {
+			return nil, redis.Error("NOSCRIPT No matching script")
+		}
+		n := fakeIndex(args[1])
+		keys := make([]string, 0, n)
+		for _, arg := range args[2 : 2+n] {
+			keys = append(keys, fakeArg(arg))
+		}
+		argv := make([]string, 0, len(args)-2-n)
+		for _, arg := range args[2+n:] {
+			argv = append(argv, fakeArg(arg))
+		}
+		return script(r, keys, argv)
+	case "EXEC":
+		queued := r.queued
+		r.multi, r.queued = false, nil
+		if r.conflicts > 0 {
+			r.conflicts--
+			return nil, nil
+		}
+		replies := make([]interface{}, 0, len(queued))
+		for _, q := range queued {
+			reply, err := r.exec(q[0].(string), q[1:]...)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, reply)
+		}
+		return replies, nil
+	}
+	return r.exec(cmd, args...)
+}
+
+func (r *fakeRedis) exec(cmd string, args ...interface{}) (interface{}, error) {
+	key := fakeArg(args[0])
+	switch strings.ToUpper(cmd) {
+	case "GET":
+		if v, ok := r.strings[key]; ok {
+			return []byte(v), nil
+		}
+		return nil, nil
+	case "SET":
+		r.strings[key] = fakeArg(args[1])
+		return "OK", nil
+	case "HKEYS":
+		keys := make([]interface{}, 0)
+		for field := range r.hashes[key] {
+			keys = append(keys, []byte(field))
+		}
+		return keys, nil
+	case "HGETALL":
+		values := make([]interface{}, 0, 2*len(r.hashes[key]))
+		for field, v := range r.hashes[key] {
+			values = append(values, []byte(field), []byte(v))
+		}
+		return values, nil
+	case "HGET":
+		if v, ok := r.hashes[key][fakeArg(args[1])]; ok {
+			return []byte(v), nil
+		}
+		return nil, nil
+	case "HMGET":
+		values := make([]interface{}, 0, len(args)-1)
+		for _, field := range args[1:] {
+			if v, ok := r.hashes[key][fakeArg(field)]; ok {
+				values = append(values, []byte(v))
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values, nil
+	case "HSET":
+		if r.hashes[key] == nil {
+			r.hashes[key] = make(map[string]string)
+		}
+		r.hashes[key][fakeArg(args[1])] = fakeArg(args[2])
+		return int64(1), nil
+	case "HDEL":
+		n := int64(0)
+		for _, field := range args[1:] {
+			if _, ok := r.hashes[key][fakeArg(field)]; ok {
+				delete(r.hashes[key], fakeArg(field))
+				n++
+			}
+		}
+		return n, nil
+	case "LLEN":
+		return int64(len(r.lists[key])), nil
+	case "LINDEX":
+		list := r.lists[key]
+		if i := fakeIndex(args[1]); i >= 0 && i < len(list) {
+			return []byte(list[i]), nil
+		}
+		return nil, nil
+	case "LSET":
+		list := r.lists[key]
+		i := fakeIndex(args[1])
+		if i < 0 || i >= len(list) {
+			return nil, redis.Error("ERR index out of range")
+		}
+		list[i] = fakeArg(args[2])
+		return "OK", nil
+	case "LRANGE":
+		list := r.lists[key]
+		start, stop := fakeIndex(args[1]), fakeIndex(args[2])
+		values := make([]interface{}, 0)
+		for i := start; i <= stop && i < len(list); i++ {
+			values = append(values, []byte(list[i]))
+		}
+		return values, nil
+	case "RPUSH":
+		for _, v := range args[1:] {
+			r.lists[key] = append(r.lists[key], fakeArg(v))
+		}
+		return int64(len(r.lists[key])), nil
+	case "SADD":
+		if r.sets[key] == nil {
+			r.sets[key] = make(map[string]struct{})
+		}
+		for _, v := range args[1:] {
+			r.sets[key][fakeArg(v)] = struct{}{}
+		}
+		return int64(len(args) - 1), nil
+	case "SMEMBERS":
+		members := make([]interface{}, 0)
+		for v := range r.sets[key] {
+			members = append(members, []byte(v))
+		}
+		return members, nil
+	}
+	return nil, fmt.Errorf("unsupported command %s", cmd)
+}
+
+func (r *fakeRedis) Send(cmd string, args ...interface{}) error {
+	cmd = strings.ToUpper(cmd)
+	if cmd == "MULTI" {
+		r.multi = true
+		return nil
+	}
+	if r.multi {
+		r.queued = append(r.queued, append([]interface{}{cmd}, args...))
+		return nil
+	}
+	_, err := r.exec(cmd, args...)
+	return err
+}
+
+func (r *fakeRedis) Close() error                  { return nil }
+func (r *fakeRedis) Err() error                    { return nil }
+func (r *fakeRedis) Flush() error                  { return nil }
+func (r *fakeRedis) Receive() (interface{}, error) { return nil, nil }
+
+var _ redis.Conn = (*fakeRedis)(nil)
+
+// 脚本的Go实现，脚本hash => 实现
+var fakeScripts = map[string]func(r *fakeRedis, keys, args []string) (interface{}, error){
+	appendChatScript.Hash(): func(r *fakeRedis, keys, args []string) (interface{}, error) {
+		n := len(r.lists[keys[0]]) + 1
+		r.lists[keys[0]] = append(r.lists[keys[0]], fmt.Sprintf(`{"chat_id":%d,%s`, n, args[0][1:]))
+		return int64(n), nil
+	},
+	presenceOfflineScript.Hash(): func(r *fakeRedis, keys, args []string) (interface{}, error) {
+		v, ok := r.hashes[keys[0]][args[0]]
+		if !ok {
+			return int64(0), nil
+		}
+		var presence struct {
+			Conn string `json:"conn"`
+		}
+		if err := json.Unmarshal([]byte(v), &presence); err != nil {
+			return nil, redis.Error("ERR user_script: Cannot decode string")
+		}
+		if presence.Conn != args[1] {
+			return int64(0), nil
+		}
+		delete(r.hashes[keys[0]], args[0])
+		return int64(1), nil
+	},
+}
@@ -0,0 +1,90 @@
+package ndscloud
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// 消息注册表：每个act声明其Go类型、校验、处理、接收者及持久化策略。
+// 新增消息类型只需在Hub.Run之前调用RegisterAct，无需修改UnmarshalMessage、Client.process和Room.msgrecvers。
+//
+// Client.process处理一条消息的顺序：
+// 解组(New) -> 填充Route -> 丢弃ServerOnly -> 校验角色(Roles) -> 限流 -> Validate -> 敏感词过滤 -> Handle -> Persist -> 按Receivers转发
+
+// 接收者策略
+const (
+	// 不转发
+	RecvNone = iota
+	// 按消息的to字段转发，消息需实现Addressed
+	RecvTo
+	// 转发给单元内所有终端
+	RecvUnit
+)
+
+// Validate/Handle/Persist返回ErrDiscard表示消息已处理完毕，不再继续持久化及转发，也不通知客户端错误(携带rid时仍回复确认)
+var ErrDiscard = errors.New("message discarded")
+
+// 消息类型定义
+type ActSpec struct {
+	// 消息act，如"6"
+	Act string
+
+	// 返回一个新的消息实例，用于解组json消息
+	New func() Message
+
+	// 只能由服务端下发，客户端发送的该类消息将被丢弃
+	ServerOnly bool
+
+	// 允许发送的角色(见permission.go)，为空时不限制，配置Cc.Permissions可覆盖
+	Roles []string
+
+	// 校验消息，返回的错误将通知客户端
+	Validate func(c *Client, message Message) error
+
+	// 处理消息，返回的错误将通知客户端
+	Handle func(c *Client, message Message) error
+
+	// 持久化消息，返回的错误将通知客户端
+	Persist func(c *Client, message Message) error
+
+	// 接收者策略: RecvNone, RecvTo, RecvUnit
+	Receivers int
+}
+
+var (
+	actMutex sync.RWMutex
+	// act到消息类型的映射
+	acts = make(map[string]*ActSpec)
+	// Go类型到消息类型的映射，用于计算服务端生成的消息的接收者
+	actTypes = make(map[reflect.Type]*ActSpec)
+)
+
+// 注册消息类型，act重复注册将panic
+func RegisterAct(spec *ActSpec) {
+	actMutex.Lock()
+	defer actMutex.Unlock()
+
+	if spec.Act == "" || spec.New == nil {
+		panic("ndscloud: RegisterAct requires Act and New")
+	}
+	if _, dup := acts[spec.Act]; dup {
+		panic("ndscloud: RegisterAct called twice for act " + spec.Act)
+	}
+	acts[spec.Act] = spec
+	actTypes[reflect.TypeOf(spec.New())] = spec
+}
+
+// 根据act获取消息类型
+func lookupAct(act string) *ActSpec {
+	actMutex.RLock()
+	defer actMutex.RUnlock()
+	return acts[act]
+}
+
+// 根据消息实例获取消息类型
+func specOf(message Message) *ActSpec {
+	actMutex.RLock()
+	defer actMutex.RUnlock()
+	return actTypes[reflect.TypeOf(message)]
+}
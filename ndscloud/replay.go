@@ -0,0 +1,204 @@
+package ndscloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/darling-kefan/xj/config"
+	"github.com/gomodule/redigo/redis"
+)
+
+// 单元消息编号及断线重连补发：
+// > 单元内每条下发的文本消息都带有单调递增的seq(Redis INCR，集群内各节点共享)
+// > 消息同时写入单元的Redis stream(ID为"seq-0")，stream长度有上限
+// > 客户端重连时携带last_seq，Room在转发实时消息之前补发其错过的消息；
+//   错过的消息已被淘汰时，下发重新同步消息(Act=16)
+
+const (
+	// 默认补发缓冲区长度
+	replaySize = 1000
+
+	// 单元编号及补发缓冲区的过期时间(秒)
+	replayTTL = 86400
+)
+
+// 编号并写入补发缓冲区
+// KEYS[1]: seq key, KEYS[2]: replay key
+// ARGV[1]: body, ARGV[2]: sender, ARGV[3]: maxlen, ARGV[4]: ttl
+var replayScript = redis.NewScript(2, `
+local seq = redis.call('INCR', KEYS[1])
+redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[3], seq .. '-0', 'sender', ARGV[2], 'body', ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+redis.call('EXPIRE', KEYS[2], ARGV[4])
+return seq
+`)
+
+// 重新同步消息Act=16，由服务端下发
+type ResyncMsg struct {
+	Act    string `json:"act"`
+	Seq    int64  `json:"seq"`
+	Reason string `json:"reason"`
+}
+
+// 补发缓冲区长度
+func replayMaxlen() int {
+	if config.Config.Cc.Replay > 0 {
+		return config.Config.Cc.Replay
+	}
+	return replaySize
+}
+
+// 为消息编号并写入补发缓冲区，失败返回0
+func (r *Room) store(body []byte, sender string) int64 {
+	return r.hub.store(r.unitId, body, sender)
+}
+
+func (h *Hub) store(unitId string, body []byte, sender string) int64 {
+	seqKey := fmt.Sprintf(seqKeyFormat, unitId)
+	replayKey := fmt.Sprintf(replayKeyFormat, unitId)
+	conn := h.pool.Get()
+	defer conn.Close()
+
+	seq, err := redis.Int64(replayScript.Do(conn, seqKey, replayKey, body, sender, replayMaxlen(), replayTTL))
+	if err != nil {
+		log.Printf("[hub] Failed to store %s to %s, error: %s\n", string(body), replayKey, err)
+		return 0
+	}
+	return seq
+}
+
+// 在json消息中加入seq字段
+func stampSeq(body []byte, seq int64) []byte {
+	if seq == 0 || len(body) < 2 || body[0] != '{' {
+		return body
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`{"seq":`)
+	buf.WriteString(strconv.FormatInt(seq, 10))
+	if !bytes.Equal(bytes.TrimSpace(body[1:]), []byte("}")) {
+		buf.WriteByte(',')
+	}
+	buf.Write(body[1:])
+	return buf.Bytes()
+}
+
+// 补发客户端错过的消息，补发完成后客户端开始接收实时消息。
+// 由Room.run调用，保证补发与实时消息不会交错。
+func (r *Room) replay(client *Client) {
+	lastSeq := client.resumeSeq
+	curSeq := int64(0)
+	defer func() {
+		client.endResume(curSeq)
+	}()
+
+	seqKey := fmt.Sprintf(seqKeyFormat, r.unitId)
+	replayKey := fmt.Sprintf(replayKeyFormat, r.unitId)
+	conn := r.hub.pool.Get()
+	defer conn.Close()
+
+	curSeq, err := redis.Int64(conn.Do("GET", seqKey))
+	if err != nil && err != redis.ErrNil {
+		log.Printf("[%s] Failed to get %s, error: %s\n", client.id, seqKey, err)
+		r.resync(client, curSeq, err.Error())
+		return
+	}
+	if lastSeq >= curSeq {
+		if lastSeq > curSeq {
+			r.resync(client, curSeq, "last_seq ahead of unit")
+		}
+		return
+	}
+
+	// 只补发到当前编号，之后的消息(含其它节点尚未到达的消息)实时转发
+	start := strconv.FormatInt(lastSeq+1, 10) + "-0"
+	end := strconv.FormatInt(curSeq, 10) + "-0"
+	entries, err := redis.Values(conn.Do("XRANGE", replayKey, start, end))
+	if err != nil {
+		log.Printf("[%s] Failed to xrange %s, error: %s\n", client.id, replayKey, err)
+		r.resync(client, curSeq, err.Error())
+		return
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	expect := lastSeq + 1
+	for _, entry := range entries {
+		seq, sender, body, err := parseReplayEntry(entry)
+		if err != nil {
+			log.Printf("[%s] %s\n", client.id, err)
+			continue
+		}
+		if seq != expect {
+			break
+		}
+		expect = seq + 1
+
+		message, err := UnmarshalMessage(body)
+		if err != nil {
+			continue
+		}
+		*message.GetRoute() = Route{Sender: sender, Unit: r.unitId}
+		// 本地终端随本地中控重连后重新上报，不补发
+		receivers, _ := r.msgrecvers(message)
+		for _, receiver := range receivers {
+			if receiver == client {
+				client.deliver(client.outbound, stampSeq(body, seq))
+				break
+			}
+		}
+	}
+
+	// 缓冲区中已没有客户端错过的全部消息
+	if expect <= curSeq {
+		log.Printf("[%s] Gap too large, last_seq: %d, replayed to: %d, current: %d\n", client.id, lastSeq, expect-1, curSeq)
+		r.resyncLocked(client, curSeq, "gap too large")
+		return
+	}
+	log.Printf("[%s] Resumed from %d to %d\n", client.id, lastSeq, curSeq)
+}
+
+// 下发重新同步消息
+func (r *Room) resync(client *Client, seq int64, reason string) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	r.resyncLocked(client, seq, reason)
+}
+
+func (r *Room) resyncLocked(client *Client, seq int64, reason string) {
+	if r.clients[client.id] != client {
+		return
+	}
+	b, _ := json.Marshal(&ResyncMsg{Act: "16", Seq: seq, Reason: reason})
+	client.deliver(client.outbound, b)
+}
+
+// 解析XRANGE返回的条目: [id, [field, value, ...]]
+func parseReplayEntry(entry interface{}) (seq int64, sender string, body []byte, err error) {
+	parts, err := redis.Values(entry, nil)
+	if err != nil || len(parts) != 2 {
+		return 0, "", nil, fmt.Errorf("Bad replay entry: %v", entry)
+	}
+	id, _ := redis.String(parts[0], nil)
+	seq, err = strconv.ParseInt(strings.Split(id, "-")[0], 10, 64)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	fields, err := redis.ByteSlices(parts[1], nil)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch string(fields[i]) {
+		case "sender":
+			sender = string(fields[i+1])
+		case "body":
+			body = fields[i+1]
+		}
+	}
+	return
+}
@@ -0,0 +1,438 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+)
+
+// 每个单元一个Room，Room在独立的goroutine中转发该单元的消息，
+// 因此一个繁忙的单元不会阻塞其它单元。
+//
+// Room.clients和Room.cache的写操作由Hub.Run完成(本地终端由本地中控的注册消息写入)，转发消息和其它接口读取时需加读锁。
+// 移除客户端时关闭其发送缓冲区(Client.closeOutbound)，之后投递给该客户端的消息被丢弃。
+
+// Room maintains the clients of one unit and broadcast messages to them.
+type Room struct {
+	hub *Hub
+
+	unitId string
+
+	// Registered clients of the unit. ID to Client mapping.
+	clients map[string]*Client
+
+	// Classification by identity.
+	cache *UnitCache
+
+	// The lock used for Room.clients and Room.cache
+	mutex sync.RWMutex
+
+	// Inbound messages from the clients of this node.
+	inbound chan Message
+
+	// Penmanship binary stream from the clients of this node.
+	inbound_pms chan *PmsMsg
+
+	// Messages from other nodes of the cluster.
+	remote chan *clusterMsg
+
+	// Penmanship binary stream from other nodes of the cluster.
+	remote_pms chan *PmsMsg
+
+	// Reconnected clients waiting for missed messages.
+	resume chan *Client
+
+	// Closed by the hub when the room is removed.
+	done chan struct{}
+
+	// Per-act rate limits of the unit on this node.
+	limits rateLimiter
+}
+
+// Classification by identity, and cache it.
+type UnitCache struct {
+	All map[string]struct{} // 定义set类型
+	Tea map[string]struct{}
+	Stu map[string]struct{}
+	Dev map[string]struct{}
+	Nds map[string]struct{}
+	// 按教室分类，教室id => set
+	Cls map[string]map[string]struct{}
+	// 本地中控上报的本地终端，本地终端id => 本地中控id
+	Loc map[string]string
+}
+
+func NewUnitCache() *UnitCache {
+	return &UnitCache{
+		All: make(map[string]struct{}),
+		Tea: make(map[string]struct{}),
+		Stu: make(map[string]struct{}),
+		Dev: make(map[string]struct{}),
+		Nds: make(map[string]struct{}),
+		Cls: make(map[string]map[string]struct{}),
+		Loc: make(map[string]string),
+	}
+}
+
+func newRoom(hub *Hub, unitId string) *Room {
+	return &Room{
+		hub:         hub,
+		unitId:      unitId,
+		clients:     make(map[string]*Client),
+		cache:       NewUnitCache(),
+		inbound:     make(chan Message),
+		inbound_pms: make(chan *PmsMsg),
+		remote:      make(chan *clusterMsg),
+		remote_pms:  make(chan *PmsMsg),
+		resume:      make(chan *Client),
+		done:        make(chan struct{}),
+	}
+}
+
+// 新增客户端，已存在返回false
+func (r *Room) add(client *Client) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.clients[client.id] == client {
+		return false
+	}
+	r.clients[client.id] = client
+	uc := r.cache
+	// 已登录的终端不再经由本地中控转发
+	if _, ok := uc.Loc[client.id]; ok {
+		r.uncacheLocked(client.id)
+	}
+	// 全体
+	uc.All[client.id] = struct{}{}
+	if client.identity == 1 {
+		// 老师
+		uc.Tea[client.id] = struct{}{}
+	} else if client.identity == 2 {
+		// 学生
+		uc.Stu[client.id] = struct{}{}
+	}
+	if client.isDevice() {
+		// 设备
+		uc.Dev[client.id] = struct{}{}
+	}
+	// 本地中控
+	if client.isLocalControl() {
+		uc.Nds[client.id] = struct{}{}
+	}
+	// 所在教室
+	if classroom := client.classroom(); classroom != "" {
+		if uc.Cls[classroom] == nil {
+			uc.Cls[classroom] = make(map[string]struct{})
+		}
+		uc.Cls[classroom][client.id] = struct{}{}
+	}
+	return true
+}
+
+// 移除客户端，并关闭其websocket连接
+func (r *Room) remove(client *Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.clients[client.id] != client {
+		return
+	}
+	// close client websocket connection
+	client.closeOutbound()
+	delete(r.clients, client.id)
+	r.uncacheLocked(client.id)
+	// 移除本地中控上报的本地终端
+	if client.isLocalControl() {
+		r.clearLocalLocked(client)
+	}
+}
+
+// 从分类缓存中移除终端
+func (r *Room) uncacheLocked(id string) {
+	uc := r.cache
+	delete(uc.All, id)
+	delete(uc.Tea, id)
+	delete(uc.Stu, id)
+	delete(uc.Dev, id)
+	delete(uc.Nds, id)
+	delete(uc.Loc, id)
+	for classroom, set := range uc.Cls {
+		delete(set, id)
+		if len(set) == 0 {
+			delete(uc.Cls, classroom)
+		}
+	}
+}
+
+// 缓存本地中控上报的本地终端，groups为终端所属的身份分类
+func (r *Room) cacheLocalLocked(nds *Client, id string, groups ...map[string]struct{}) {
+	// 同一id已登录或属于其它本地中控
+	if _, ok := r.clients[id]; ok {
+		return
+	}
+	if owner, ok := r.cache.Loc[id]; ok && owner != nds.id {
+		return
+	}
+	uc := r.cache
+	uc.Loc[id] = nds.id
+	uc.All[id] = struct{}{}
+	for _, set := range groups {
+		set[id] = struct{}{}
+	}
+	// 本地终端与本地中控在同一教室
+	if classroom := nds.classroom(); classroom != "" {
+		if uc.Cls[classroom] == nil {
+			uc.Cls[classroom] = make(map[string]struct{})
+		}
+		uc.Cls[classroom][id] = struct{}{}
+	}
+}
+
+// 新增本地用户
+func (r *Room) addLocalUser(nds *Client, item *LocalUsrRegItem) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.clients[nds.id] != nds {
+		return
+	}
+	switch item.Idt {
+	case "1":
+		r.cacheLocalLocked(nds, item.Uid, r.cache.Tea)
+	case "2":
+		r.cacheLocalLocked(nds, item.Uid, r.cache.Stu)
+	default:
+		r.cacheLocalLocked(nds, item.Uid)
+	}
+}
+
+// 新增本地设备
+func (r *Room) addLocalDevice(nds *Client, item *LocalDevRegItem) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.clients[nds.id] != nds {
+		return
+	}
+	r.cacheLocalLocked(nds, item.Did, r.cache.Dev)
+}
+
+// 移除本地终端
+func (r *Room) removeLocal(nds *Client, id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.cache.Loc[id] == nds.id {
+		r.uncacheLocked(id)
+	}
+}
+
+// 移除本地中控上报的所有本地终端
+func (r *Room) clearLocal(nds *Client) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.clearLocalLocked(nds)
+}
+
+func (r *Room) clearLocalLocked(nds *Client) {
+	for id, owner := range r.cache.Loc {
+		if owner == nds.id {
+			r.uncacheLocked(id)
+		}
+	}
+}
+
+// 获取单元所有客户端
+func (r *Room) list() []*Client {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	list := make([]*Client, 0, len(r.clients))
+	for _, client := range r.clients {
+		list = append(list, client)
+	}
+	return list
+}
+
+// 移除所有客户端
+func (r *Room) clear() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, client := range r.clients {
+		client.closeOutbound()
+	}
+	r.clients = make(map[string]*Client)
+	r.cache = NewUnitCache()
+}
+
+// 客户端是否在单元内
+func (r *Room) has(client *Client) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.clients[client.id] == client
+}
+
+// 单元内是否还有客户端
+func (r *Room) empty() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.clients) == 0
+}
+
+// 根据消息里的To字段，计算出将消息推送给谁，语法见to.go
+func (r *Room) getrecversbyto(to string) map[string]struct{} {
+	expr, err := ParseTo(to)
+	if err != nil {
+		log.Printf("[room] %s\n", err)
+		return nil
+	}
+	return expr.Eval(r.cache)
+}
+
+// Calculate message receivers.
+// Determine which clients to send to, according to ActSpec.Receivers.
+// 本地终端的消息经由其本地中控转发，locals为本地中控 => 本地终端id
+func (r *Room) msgrecvers(message Message) (receivers []*Client, locals map[*Client][]string) {
+	spec := specOf(message)
+	if spec == nil {
+		return
+	}
+
+	// The set of receivers
+	var receiverSet map[string]struct{}
+	switch spec.Receivers {
+	case RecvTo:
+		if msg, ok := message.(Addressed); ok {
+			receiverSet = r.getrecversbyto(msg.GetTo())
+		}
+	case RecvUnit:
+		receiverSet = r.cache.All
+	}
+
+	// The sender of the message
+	sender := message.GetRoute().Sender
+	receivers = make([]*Client, 0, len(receiverSet))
+	for id, _ := range receiverSet {
+		// Remove sender
+		if sender == id {
+			continue
+		}
+		// 判断to中的个人id是否已经注册到本单元
+		if client, ok := r.clients[id]; ok {
+			receivers = append(receivers, client)
+			continue
+		}
+		// 本地终端，发送者为其本地中控时不再转发
+		if owner, ok := r.cache.Loc[id]; ok && owner != sender {
+			if nds, ok := r.clients[owner]; ok {
+				if locals == nil {
+					locals = make(map[*Client][]string)
+				}
+				locals[nds] = append(locals[nds], id)
+			}
+		}
+	}
+	return
+}
+
+// 计算笔迹流接收者：单元内拉取该笔迹的客户端(不包括发送者)
+func (r *Room) pmsrecvers(message *PmsMsg) (receivers []*Client) {
+	for id, client := range r.clients {
+		if id == message.Sender {
+			continue
+		}
+		if client.isPullingInk(message.Uid) {
+			receivers = append(receivers, client)
+		}
+	}
+	return
+}
+
+// 转发消息给本节点的客户端，body为消息的json编码，seq为0表示消息未编号
+func (r *Room) broadcast(message Message, body []byte, seq int64) {
+	msg := stampSeq(body, seq)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	receivers, locals := r.msgrecvers(message)
+	log.Printf("Message: %#v, receivers: %d, local controls: %d\n", message, len(receivers), len(locals))
+	for _, client := range receivers {
+		// 补发中的客户端由Room.replay从补发缓冲区读取该消息，已补发的消息不再实时转发
+		if client.skipLive(seq) {
+			continue
+		}
+		client.deliver(client.outbound, msg)
+		log.Printf("Send %v to %v\n", string(msg), client.id)
+	}
+	for nds, ids := range locals {
+		if nds.skipLive(seq) {
+			continue
+		}
+		for _, id := range ids {
+			b, err := json.Marshal(&LocalEnvelopeMsg{Act: "17", Rcv: id, Msg: msg})
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			nds.deliver(nds.outbound, b)
+			log.Printf("Send %v to %v via %v\n", string(msg), id, nds.id)
+		}
+	}
+}
+
+// 转发笔迹流给本节点拉取该笔迹的客户端
+func (r *Room) broadcastPms(message *PmsMsg) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, client := range r.pmsrecvers(message) {
+		client.deliver(client.outbound_pms, message.Raw)
+	}
+}
+
+func (r *Room) run() {
+	defer func() {
+		log.Printf("[room] End %s\n", r.unitId)
+	}()
+	cluster := r.hub.cluster
+	for {
+		select {
+		case message := <-r.inbound:
+			body, err := json.Marshal(message)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			seq := r.store(body, message.GetRoute().Sender)
+			r.broadcast(message, body, seq)
+			if cluster != nil {
+				cluster.publish(message, body, seq)
+			}
+		case message := <-r.inbound_pms:
+			r.broadcastPms(message)
+			if cluster != nil {
+				cluster.publishPms(message)
+			}
+		case cm := <-r.remote:
+			message, err := UnmarshalMessage(cm.Body)
+			if err != nil {
+				log.Printf("[cluster] %s\n", err)
+				continue
+			}
+			*message.GetRoute() = Route{Sender: cm.Sender, Unit: cm.Unit}
+			r.broadcast(message, cm.Body, cm.Seq)
+		case message := <-r.remote_pms:
+			r.broadcastPms(message)
+		case client := <-r.resume:
+			r.replay(client)
+		case <-r.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package ndscloud
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 单元消息转发基准：测量一条消息经Room.broadcast转发给单元所有终端(并被消费)的耗时。
+// BusyNeighbour在另一个单元持续转发消息(终端消费慢)的同时测量，对比各单元独立转发的效果。
+//
+// go test -run NONE -bench RoomBroadcast ./ndscloud
+
+const (
+	benchClients = 40
+	// 繁忙单元的终端处理一条消息的耗时
+	benchSlowCost = 200 * time.Microsecond
+)
+
+// 测试用客户端，wg不为nil时每消费一条消息调用一次Done
+func newTestClient(hub *Hub, unitId, id string, wg *sync.WaitGroup, cost time.Duration) *Client {
+	c := &Client{
+		hub:          hub,
+		id:           id,
+		identity:     2,
+		info:         &UserInfo{Uid: id},
+		unitId:       unitId,
+		unitInfo:     &UnitInfo{SceneId: 1},
+		outbound:     make(chan []byte, outboundSize),
+		outbound_pms: make(chan []byte, outboundSize),
+		stopreg:      make(chan struct{}),
+		pullInks:     make(map[string]struct{}),
+		overflow:     OverflowDropOldest,
+		inkAt:        make(map[string]int64),
+		isRegistered: true,
+	}
+	go func() {
+		for range c.outbound {
+			if cost > 0 {
+				time.Sleep(cost)
+			}
+			if wg != nil {
+				wg.Done()
+			}
+		}
+	}()
+	return c
+}
+
+// 创建单元并加入n个客户端，返回单元的Room
+func newTestRoom(hub *Hub, unitId string, n int, wg *sync.WaitGroup, cost time.Duration) *Room {
+	clients := make([]*Client, 0, n)
+	for i := 0; i < n; i++ {
+		clients = append(clients, newTestClient(hub, unitId, fmt.Sprintf("%s-%d", unitId, i), wg, cost))
+	}
+	hub.add(clients...)
+	return hub.room(unitId)
+}
+
+func broadcastOrdinary(room *Room) {
+	message := &OrdinaryMsg{Act: "6", From: "0", To: "A", Msg: "bench", Route: Route{Sender: "0", Unit: room.unitId}}
+	room.broadcast(message, []byte(`{"act":"6","from":"0","to":"A","msg":"bench"}`), 0)
+}
+
+func benchmarkRoomBroadcast(b *testing.B, busy bool) {
+	hub := NewHub()
+	wg := new(sync.WaitGroup)
+	quiet := newTestRoom(hub, "quiet", benchClients, wg, 0)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	if busy {
+		room := newTestRoom(hub, "busy", benchClients, nil, benchSlowCost)
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					broadcastOrdinary(room)
+					runtime.Gosched()
+				}
+			}
+		}()
+	} else {
+		close(done)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wg.Add(benchClients)
+		broadcastOrdinary(quiet)
+		wg.Wait()
+	}
+	b.StopTimer()
+
+	close(stop)
+	<-done
+	hub.removebyunitid("quiet")
+	hub.removebyunitid("busy")
+}
+
+func BenchmarkRoomBroadcast(b *testing.B) {
+	benchmarkRoomBroadcast(b, false)
+}
+
+func BenchmarkRoomBroadcastBusyNeighbour(b *testing.B) {
+	benchmarkRoomBroadcast(b, true)
+}
@@ -0,0 +1,112 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 单元场景：每次上课为一个场景，场景id从1开始，nc:unit:scene:id:{unit}为当前场景id。
+// 开始课程时写入nc:unit:scene:{unit}:{scene}(start_time)，结束时补充end_time并自增场景id
+
+// 场景状态
+const (
+	sceneNotStarted = "not_started"
+	sceneOngoing    = "ongoing"
+	sceneEnded      = "ended"
+)
+
+// 场景概要
+type sceneSummary struct {
+	SceneId   int    `json:"scene_id"`
+	Status    string `json:"status"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	// 时长(秒)，进行中的场景计算到当前时间
+	Duration int64 `json:"duration"`
+	// 聊天消息数
+	Chats int `json:"chats"`
+	// 模块状态指令数
+	Instructions int `json:"instructions"`
+	// 有笔迹的终端id
+	InkUsers []string `json:"ink_users"`
+}
+
+// 查询单元的所有场景，按场景id升序
+func unitScenes(redconn redis.Conn, unitId string) ([]*sceneSummary, error) {
+	sceneId, err := redis.Int(redconn.Do("GET", fmt.Sprintf(sceneIdKeyFormat, unitId)))
+	if err == redis.ErrNil {
+		return make([]*sceneSummary, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scenes := make([]*sceneSummary, 0, sceneId)
+	for id := 1; id <= sceneId; id++ {
+		scene, err := loadScene(redconn, unitId, id)
+		if err != nil {
+			return nil, err
+		}
+		scenes = append(scenes, scene)
+	}
+	return scenes, nil
+}
+
+// 查询场景的时间、聊天及模块指令数、有笔迹的终端
+func loadScene(redconn redis.Conn, unitId string, sceneId int) (*sceneSummary, error) {
+	scene := &sceneSummary{SceneId: sceneId, Status: sceneNotStarted}
+
+	b, err := redis.Bytes(redconn.Do("GET", fmt.Sprintf(sceneKeyFormat, unitId, sceneId)))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if b != nil {
+		var info struct {
+			StartTime int64 `json:"start_time"`
+			EndTime   int64 `json:"end_time"`
+		}
+		if err := json.Unmarshal(b, &info); err != nil {
+			return nil, err
+		}
+		if info.StartTime > 0 {
+			scene.Status = sceneOngoing
+			scene.StartTime = time.Unix(info.StartTime, 0).Format("2006-01-02 15:04:05")
+			scene.Duration = time.Now().Unix() - info.StartTime
+		}
+		if info.EndTime > 0 {
+			scene.Status = sceneEnded
+			scene.EndTime = time.Unix(info.EndTime, 0).Format("2006-01-02 15:04:05")
+			if info.StartTime > 0 {
+				scene.Duration = info.EndTime - info.StartTime
+			}
+		}
+	}
+
+	scene.Chats, err = redis.Int(redconn.Do("LLEN", fmt.Sprintf(chatKeyFormat, unitId, sceneId)))
+	if err != nil {
+		return nil, err
+	}
+
+	mods, err := redis.Strings(redconn.Do("HKEYS", fmt.Sprintf(modInsKeyFormat, unitId, sceneId)))
+	if err != nil {
+		return nil, err
+	}
+	for _, mod := range mods {
+		n, err := redis.Int(redconn.Do("LLEN", fmt.Sprintf(modInsHistoryKeyFormat, unitId, sceneId, mod)))
+		if err != nil {
+			return nil, err
+		}
+		scene.Instructions += n
+	}
+
+	scene.InkUsers, err = redis.Strings(redconn.Do("SMEMBERS", fmt.Sprintf(inkUsersKeyFormat, unitId, sceneId)))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(scene.InkUsers)
+	return scene, nil
+}
@@ -0,0 +1,149 @@
+package ndscloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/darling-kefan/xj/config"
+	"github.com/gomodule/redigo/redis"
+)
+
+// 同步消息Act=22：客户端注册完成后推送，内容为
+// > 当前场景id及开始时间(nc:unit:scene:{unit}:{scene})
+// > 当前模块状态(nc:ins:mod:{unit}:{scene})，按更新时间降序
+// > 最近的聊天消息(nc:chat:his:{unit}:{scene})，只含该客户端可见的消息
+// > 在线终端，同ServeUsers
+// 查询失败时只记录日志，不影响注册。
+// 客户端连接时已加入Room(forceLogin)，同步消息在注册消息的确认之后经由发送缓冲区发送，
+// 不在单元内的客户端(如已被断开)不再推送
+
+// 默认同步的聊天消息条数
+const syncChatsDefault = 20
+
+func (c *Client) sync() {
+	if room := c.hub.room(c.unitId); room == nil || !room.has(c) {
+		return
+	}
+	message := &SyncMsg{
+		Act:       "22",
+		SceneId:   c.unitInfo.SceneId,
+		Curmod:    c.unitInfo.Curmod,
+		Mods:      make([]*ModStatusMsg, 0),
+		Chats:     make([]*SyncChat, 0),
+		Roster:    make([]interface{}, 0),
+		CreatedAt: time.Now().Unix(),
+	}
+
+	var err error
+	if message.StartTime, err = syncStartTime(c.redconn, c.unitId, c.unitInfo.SceneId); err != nil {
+		log.Printf("[%s] Failed to sync scene: %s\n", c.id, err)
+	}
+	if mods, err := syncMods(c.redconn, c.unitId, c.unitInfo.SceneId); err != nil {
+		log.Printf("[%s] Failed to sync module status: %s\n", c.id, err)
+	} else {
+		message.Mods = mods
+	}
+	n := config.Config.Cc.SyncChats
+	if n == 0 {
+		n = syncChatsDefault
+	}
+	if n > 0 {
+		if chats, err := syncChats(c.redconn, c.unitId, c.unitInfo.SceneId, c.id, n); err != nil {
+			log.Printf("[%s] Failed to sync chats: %s\n", c.id, err)
+		} else {
+			message.Chats = chats
+		}
+	}
+	if roster, err := c.hub.roster(c.unitId); err != nil {
+		log.Printf("[%s] Failed to sync roster: %s\n", c.id, err)
+	} else {
+		message.Roster = roster
+	}
+
+	b, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("[%s] Failed to json.Marshal: %s\n", c.id, err)
+		return
+	}
+	c.send(b)
+	log.Printf("[%s] Sync scene %d: %d mods, %d chats, %d online\n", c.id, message.SceneId, len(message.Mods), len(message.Chats), len(message.Roster))
+}
+
+// 场景开始时间，未开始时为0
+func syncStartTime(redconn redis.Conn, unitId string, sceneId int) (int64, error) {
+	b, err := redis.Bytes(redconn.Do("GET", fmt.Sprintf(sceneKeyFormat, unitId, sceneId)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var scene struct {
+		StartTime int64 `json:"start_time"`
+	}
+	if err := json.Unmarshal(b, &scene); err != nil {
+		return 0, err
+	}
+	return scene.StartTime, nil
+}
+
+func syncMods(redconn redis.Conn, unitId string, sceneId int) ([]*ModStatusMsg, error) {
+	values, err := redis.StringMap(redconn.Do("HGETALL", fmt.Sprintf(modInsKeyFormat, unitId, sceneId)))
+	if err != nil {
+		return nil, err
+	}
+	mods := make([]*ModStatusMsg, 0, len(values))
+	for _, v := range values {
+		modstat := new(ModStatusMsg)
+		if err := json.Unmarshal([]byte(v), modstat); err != nil {
+			return nil, err
+		}
+		mods = append(mods, modstat)
+	}
+	sort.Slice(mods, func(i, j int) bool { return mods[i].UpdatedAt > mods[j].UpdatedAt })
+	return mods, nil
+}
+
+// 最近n条聊天记录中viewer可见的消息，按chat_id升序
+func syncChats(redconn redis.Conn, unitId string, sceneId int, viewer string, n int) ([]*SyncChat, error) {
+	chatKey := fmt.Sprintf(chatKeyFormat, unitId, sceneId)
+	count, err := redis.Int(redconn.Do("LLEN", chatKey))
+	if err != nil {
+		return nil, err
+	}
+	sp := count - n
+	if sp < 0 {
+		sp = 0
+	}
+	chats := make([]*SyncChat, 0)
+	if count == 0 {
+		return chats, nil
+	}
+	res, err := redis.ByteSlices(redconn.Do("LRANGE", chatKey, sp, count-1))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range res {
+		var record chatRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return nil, err
+		}
+		if !record.visibleTo(viewer) {
+			continue
+		}
+		// 早期的记录未保存chat_id
+		if record.ChatId == 0 {
+			record.ChatId = int64(sp + k + 1)
+		}
+		chats = append(chats, &SyncChat{
+			ChatTextMsg: record.ChatTextMsg,
+			Recalled:    record.Recalled,
+			RecalledBy:  record.RecalledBy,
+			RecalledAt:  record.RecalledAt,
+		})
+	}
+	return chats, nil
+}
@@ -0,0 +1,347 @@
+package ndscloud
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 课程时间线：将场景内的模块状态指令、聊天消息、单元控制(开始/结束课程)及笔迹段标记
+// 合并为按时间排序的事件流，用于课程回放。
+// 事件按(时间, 次序, 来源, 位置)排序，id即为该排序键。各来源只追加且按时间追加，
+// 查询时从游标处分批读取各来源，逐个合并出时间最早的事件，达到limit即停止；
+// 游标记录各来源下一个未返回事件的位置
+// 事件类型
+const (
+	timelineControl = "control"
+	timelineMod     = "mod"
+	timelineChat    = "chat"
+	timelineInk     = "ink"
+)
+
+// 同一秒内的次序：开始课程最先，结束课程最后
+const (
+	rankStart = iota
+	rankEvent
+	rankEnd
+)
+
+// 同一终端的笔迹间隔超过该时长(秒)时开始新的笔迹段
+const inkSegmentGap = 5
+
+// 笔迹段标记，Offset为该段第一帧在nc:pms:{unit}:{scene}:{uid}中的位置(从0开始)
+type inkSegment struct {
+	Uid       string `json:"uid"`
+	Sender    string `json:"sender"`
+	Offset    int64  `json:"offset"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// 时间线事件
+type timelineEvent struct {
+	Id   string      `json:"id"`
+	Type string      `json:"type"`
+	At   int64       `json:"at"`
+	Data interface{} `json:"data"`
+
+	key timelineKey
+}
+
+type timelineKey struct {
+	at     int64
+	rank   int
+	index  int64
+	source string
+}
+
+func (k timelineKey) String() string {
+	return fmt.Sprintf("%d.%d.%d.%s", k.at, k.rank, k.index, k.source)
+}
+
+func (k timelineKey) less(o timelineKey) bool {
+	if k.at != o.at {
+		return k.at < o.at
+	}
+	if k.rank != o.rank {
+		return k.rank < o.rank
+	}
+	if k.source != o.source {
+		return k.source < o.source
+	}
+	return k.index < o.index
+}
+
+// 每次从来源读取的事件数
+const timelineChunk = 100
+
+// 分页游标，来源 => 下一个未返回事件的位置
+type timelineCursor map[string]int64
+
+func (c timelineCursor) String() string {
+	b, _ := json.Marshal(map[string]int64(c))
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// 解析分页游标，为空时从头开始
+func parseTimelineCursor(cursor string) (timelineCursor, error) {
+	c := make(timelineCursor)
+	if cursor == "" {
+		return c, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || json.Unmarshal(b, &c) != nil {
+		return nil, errors.New("bad cursor")
+	}
+	for _, pos := range c {
+		if pos < 0 {
+			return nil, errors.New("bad cursor")
+		}
+	}
+	return c, nil
+}
+
+func newTimelineEvent(typ string, k timelineKey, data interface{}) *timelineEvent {
+	return &timelineEvent{Id: k.String(), Type: typ, At: k.at, Data: data, key: k}
+}
+
+// 时间线的一个来源，从pos开始按追加顺序分批读取
+type timelineSource struct {
+	name string
+	key  string
+	pos  int64
+	// 已读取未返回的事件
+	buf []*timelineEvent
+	eof bool
+	// 解码位置index的记录，返回nil时跳过该记录
+	decode func(index int64, b []byte) (*timelineEvent, error)
+}
+
+// 下一个事件，来源已读完时返回nil
+func (s *timelineSource) peek(redconn redis.Conn) (*timelineEvent, error) {
+	for len(s.buf) == 0 && !s.eof {
+		start := s.pos
+		res, err := redis.ByteSlices(redconn.Do("LRANGE", s.key, start, start+timelineChunk-1))
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range res {
+			event, err := s.decode(start+int64(i), v)
+			if err != nil {
+				return nil, err
+			}
+			if event == nil {
+				// 跳过的记录不再读取
+				if len(s.buf) == 0 {
+					s.pos = start + int64(i) + 1
+				}
+				continue
+			}
+			s.buf = append(s.buf, event)
+		}
+		s.eof = len(res) < timelineChunk
+	}
+	if len(s.buf) == 0 {
+		return nil, nil
+	}
+	return s.buf[0], nil
+}
+
+func (s *timelineSource) pop() {
+	s.pos = s.buf[0].key.index + 1
+	s.buf = s.buf[1:]
+}
+
+// 单元控制事件取自场景信息，开始课程的位置为0，结束课程为1
+func controlSource(redconn redis.Conn, unitId string, sceneId int, pos int64) (*timelineSource, error) {
+	s := &timelineSource{name: timelineControl, pos: pos, eof: true}
+	b, err := redis.Bytes(redconn.Do("GET", fmt.Sprintf(sceneKeyFormat, unitId, sceneId)))
+	if err == redis.ErrNil {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info struct {
+		StartTime int64 `json:"start_time"`
+		EndTime   int64 `json:"end_time"`
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, err
+	}
+	if info.StartTime > 0 && pos <= 0 {
+		k := timelineKey{at: info.StartTime, rank: rankStart, index: 0, source: timelineControl}
+		s.buf = append(s.buf, newTimelineEvent(timelineControl, k, map[string]string{"stat": "1"}))
+	}
+	if info.EndTime > 0 && pos <= 1 {
+		k := timelineKey{at: info.EndTime, rank: rankEnd, index: 1, source: timelineControl}
+		s.buf = append(s.buf, newTimelineEvent(timelineControl, k, map[string]string{"stat": "2"}))
+	}
+	return s, nil
+}
+
+// 场景时间线的各来源，cursor为各来源的起始位置
+func timelineSources(redconn redis.Conn, unitId string, sceneId int, viewer string, cursor timelineCursor) ([]*timelineSource, error) {
+	control, err := controlSource(redconn, unitId, sceneId, cursor[timelineControl])
+	if err != nil {
+		return nil, err
+	}
+	sources := []*timelineSource{control}
+
+	// 模块状态指令，来源为模块
+	mods, err := redis.Strings(redconn.Do("HKEYS", fmt.Sprintf(modInsKeyFormat, unitId, sceneId)))
+	if err != nil {
+		return nil, err
+	}
+	for _, mod := range mods {
+		name := timelineMod + ":" + mod
+		sources = append(sources, &timelineSource{
+			name: name,
+			key:  fmt.Sprintf(modInsHistoryKeyFormat, unitId, sceneId, mod),
+			pos:  cursor[name],
+			decode: func(index int64, b []byte) (*timelineEvent, error) {
+				modins := new(ModStatusMsg)
+				if err := json.Unmarshal(b, modins); err != nil {
+					return nil, err
+				}
+				k := timelineKey{at: modins.CreatedAt, rank: rankEvent, index: index, source: name}
+				return newTimelineEvent(timelineMod, k, modins), nil
+			},
+		})
+	}
+
+	// 聊天消息，只含viewer可见的消息
+	sources = append(sources, &timelineSource{
+		name: timelineChat,
+		key:  fmt.Sprintf(chatKeyFormat, unitId, sceneId),
+		pos:  cursor[timelineChat],
+		decode: func(index int64, b []byte) (*timelineEvent, error) {
+			var record chatRecord
+			if err := json.Unmarshal(b, &record); err != nil {
+				return nil, err
+			}
+			if !record.visibleTo(viewer) {
+				return nil, nil
+			}
+			// 早期的记录未保存chat_id
+			if record.ChatId == 0 {
+				record.ChatId = index + 1
+			}
+			k := timelineKey{at: record.CreatedAt, rank: rankEvent, index: index, source: timelineChat}
+			return newTimelineEvent(timelineChat, k, &SyncChat{
+				ChatTextMsg: record.ChatTextMsg,
+				Recalled:    record.Recalled,
+				RecalledBy:  record.RecalledBy,
+				RecalledAt:  record.RecalledAt,
+			}), nil
+		},
+	})
+
+	// 笔迹段标记
+	sources = append(sources, &timelineSource{
+		name: timelineInk,
+		key:  fmt.Sprintf(inkSegmentKeyFormat, unitId, sceneId),
+		pos:  cursor[timelineInk],
+		decode: func(index int64, b []byte) (*timelineEvent, error) {
+			seg := new(inkSegment)
+			if err := json.Unmarshal(b, seg); err != nil {
+				return nil, err
+			}
+			k := timelineKey{at: seg.CreatedAt, rank: rankEvent, index: index, source: timelineInk}
+			return newTimelineEvent(timelineInk, k, seg), nil
+		},
+	})
+	return sources, nil
+}
+
+// 查询场景的时间线，从cursor处起依次将事件交给emit，limit为0时不限制条数。
+// 返回下一页的游标，没有更多事件时为空
+func sceneTimeline(redconn redis.Conn, unitId string, sceneId int, viewer string, cursor timelineCursor, limit int, emit func(*timelineEvent) error) (string, error) {
+	sources, err := timelineSources(redconn, unitId, sceneId, viewer, cursor)
+	if err != nil {
+		return "", err
+	}
+	for n := 0; ; n++ {
+		// 各来源的下一个事件中最早的一个
+		var next *timelineSource
+		var first *timelineEvent
+		for _, s := range sources {
+			event, err := s.peek(redconn)
+			if err != nil {
+				return "", err
+			}
+			if event != nil && (first == nil || event.key.less(first.key)) {
+				next, first = s, event
+			}
+		}
+		if first == nil {
+			return "", nil
+		}
+		if limit > 0 && n == limit {
+			break
+		}
+		if err := emit(first); err != nil {
+			return "", err
+		}
+		next.pop()
+	}
+
+	for _, s := range sources {
+		if s.pos > 0 {
+			cursor[s.name] = s.pos
+		}
+	}
+	return cursor.String(), nil
+}
+
+// 场景的事件总数，含viewer不可见的定向聊天消息
+func sceneTimelineTotal(redconn redis.Conn, unitId string, sceneId int) (int, error) {
+	control, err := controlSource(redconn, unitId, sceneId, 0)
+	if err != nil {
+		return 0, err
+	}
+	keys := []string{fmt.Sprintf(chatKeyFormat, unitId, sceneId), fmt.Sprintf(inkSegmentKeyFormat, unitId, sceneId)}
+	mods, err := redis.Strings(redconn.Do("HKEYS", fmt.Sprintf(modInsKeyFormat, unitId, sceneId)))
+	if err != nil {
+		return 0, err
+	}
+	for _, mod := range mods {
+		keys = append(keys, fmt.Sprintf(modInsHistoryKeyFormat, unitId, sceneId, mod))
+	}
+
+	total := len(control.buf)
+	for _, key := range keys {
+		n, err := redis.Int(redconn.Do("LLEN", key))
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// 记录笔迹段标记及有笔迹的终端，由processPms调用。同一终端的笔迹间隔超过inkSegmentGap时视为新的笔迹段
+func (c *Client) markInk(uid string, offset int64) {
+	now := time.Now().Unix()
+	last, ok := c.inkAt[uid]
+	c.inkAt[uid] = now
+	if ok && now-last <= inkSegmentGap {
+		return
+	}
+
+	b, _ := json.Marshal(&inkSegment{Uid: uid, Sender: c.id, Offset: offset, CreatedAt: now})
+	segKey := fmt.Sprintf(inkSegmentKeyFormat, c.unitId, c.unitInfo.SceneId)
+	usersKey := fmt.Sprintf(inkUsersKeyFormat, c.unitId, c.unitInfo.SceneId)
+	c.redconn.Send("MULTI")
+	c.redconn.Send("RPUSH", segKey, b)
+	c.redconn.Send("SADD", usersKey, uid)
+	if _, err := c.redconn.Do("EXEC"); err != nil {
+		log.Printf("[%s] Failed to RPUSH %s, error: %s\n", c.id, segKey, err)
+		return
+	}
+	log.Printf("[%s] RPUSH %s %s\n", c.id, segKey, b)
+}
@@ -0,0 +1,152 @@
+package ndscloud
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// 场景u1:1：开始于100，结束于200；模块m1、m2的指令，公开及定向聊天，笔迹段
+func newTimelineRedis() *fakeRedis {
+	r := newFakeRedis()
+	r.strings[fmt.Sprintf(sceneKeyFormat, "u1", 1)] = `{"start_time":100,"end_time":200}`
+	r.hashes[fmt.Sprintf(modInsKeyFormat, "u1", 1)] = map[string]string{"m1": "{}", "m2": "{}"}
+	for _, at := range []int64{100, 120, 150} {
+		r.rpush(fmt.Sprintf(modInsHistoryKeyFormat, "u1", 1, "m1"), &ModStatusMsg{Act: "7", Mod: "m1", CreatedAt: at})
+	}
+	for _, at := range []int64{110, 150} {
+		r.rpush(fmt.Sprintf(modInsHistoryKeyFormat, "u1", 1, "m2"), &ModStatusMsg{Act: "7", Mod: "m2", CreatedAt: at})
+	}
+	chatKey := fmt.Sprintf(chatKeyFormat, "u1", 1)
+	r.rpush(chatKey, &chatRecord{ChatTextMsg: ChatTextMsg{Act: "15", ChatId: 1, From: "s1", CreatedAt: 105}})
+	r.rpush(chatKey, &chatRecord{ChatTextMsg: ChatTextMsg{Act: "15", ChatId: 2, From: "t1", To: "s2", CreatedAt: 130}, Visible: []string{"s2", "t1"}})
+	r.rpush(chatKey, &chatRecord{ChatTextMsg: ChatTextMsg{Act: "15", ChatId: 3, From: "s2", CreatedAt: 150}})
+	r.rpush(fmt.Sprintf(inkSegmentKeyFormat, "u1", 1), &inkSegment{Uid: "t1", Sender: "t1", CreatedAt: 140})
+	return r
+}
+
+// 按limit逐页读取全部事件
+func readTimeline(t *testing.T, r *fakeRedis, viewer string, limit int) []string {
+	t.Helper()
+	ids := make([]string, 0)
+	cursor := ""
+	for page := 0; page < 100; page++ {
+		c, err := parseTimelineCursor(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		cursor, err = sceneTimeline(r, "u1", 1, viewer, c, limit, func(event *timelineEvent) error {
+			ids = append(ids, event.Id)
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit > 0 && n > limit {
+			t.Fatalf("got %d events, limit %d", n, limit)
+		}
+		if cursor == "" {
+			return ids
+		}
+	}
+	t.Fatal("cursor never ends")
+	return nil
+}
+
+func TestSceneTimeline(t *testing.T) {
+	r := newTimelineRedis()
+	want := []string{
+		"100.0.0.control",
+		"100.1.0.mod:m1",
+		"105.1.0.chat",
+		"110.1.0.mod:m2",
+		"120.1.1.mod:m1",
+		"140.1.0.ink",
+		"150.1.2.chat",
+		"150.1.2.mod:m1",
+		"150.1.1.mod:m2",
+		"200.2.1.control",
+	}
+	for _, limit := range []int{0, 1, 2, 3, 100} {
+		got := readTimeline(t, r, "s1", limit)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("limit %d: got %v, want %v", limit, got, want)
+		}
+	}
+
+	// 定向消息只对其可见者可见
+	got := readTimeline(t, r, "s2", 0)
+	if len(got) != len(want)+1 || got[5] != "130.1.1.chat" {
+		t.Errorf("s2: got %v", got)
+	}
+
+	total, err := sceneTimelineTotal(r, "u1", 1)
+	if err != nil || total != 11 {
+		t.Errorf("total: got %d, %v, want 11", total, err)
+	}
+}
+
+// 游标之后追加的事件在下一页返回
+func TestSceneTimelineAppend(t *testing.T) {
+	r := newTimelineRedis()
+	cursor, err := sceneTimeline(r, "u1", 1, "s1", make(timelineCursor), 9, func(*timelineEvent) error { return nil })
+	if err != nil || cursor == "" {
+		t.Fatalf("got cursor %q, %v", cursor, err)
+	}
+	r.rpush(fmt.Sprintf(modInsHistoryKeyFormat, "u1", 1, "m1"), &ModStatusMsg{Act: "7", Mod: "m1", CreatedAt: 160})
+
+	c, err := parseTimelineCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0)
+	cursor, err = sceneTimeline(r, "u1", 1, "s1", c, 0, func(event *timelineEvent) error {
+		ids = append(ids, event.Id)
+		return nil
+	})
+	if err != nil || cursor != "" || strings.Join(ids, " ") != "160.1.3.mod:m1 200.2.1.control" {
+		t.Errorf("got %v, cursor %q, %v", ids, cursor, err)
+	}
+}
+
+func TestParseTimelineCursor(t *testing.T) {
+	c := timelineCursor{"chat": 3, "mod:a.b": 2}
+	got, err := parseTimelineCursor(c.String())
+	if err != nil || len(got) != 2 || got["chat"] != 3 || got["mod:a.b"] != 2 {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if c, err := parseTimelineCursor("e30"); err != nil || len(c) != 0 {
+		t.Errorf("empty cursor: got %v, %v", c, err)
+	}
+	// 旧格式的事件id、负数位置
+	for _, cursor := range []string{"100.1.0.chat", "eyJjaGF0IjotMX0"} {
+		if _, err := parseTimelineCursor(cursor); err == nil {
+			t.Errorf("%s: got no error", cursor)
+		}
+	}
+}
+
+// 跨越多批不可见的聊天消息
+func TestSceneTimelineSkipInvisible(t *testing.T) {
+	r := newFakeRedis()
+	chatKey := fmt.Sprintf(chatKeyFormat, "u1", 1)
+	for i := 0; i < timelineChunk*2+10; i++ {
+		r.rpush(chatKey, &chatRecord{ChatTextMsg: ChatTextMsg{Act: "15", From: "t1", To: "s2", CreatedAt: 100}, Visible: []string{"s2", "t1"}})
+	}
+	r.rpush(chatKey, &chatRecord{ChatTextMsg: ChatTextMsg{Act: "15", From: "s1", CreatedAt: 101}})
+
+	got := readTimeline(t, r, "s1", 1)
+	if strings.Join(got, " ") != "101.1.210.chat" {
+		t.Errorf("got %v", got)
+	}
+	var chat *SyncChat
+	sceneTimeline(r, "u1", 1, "s1", make(timelineCursor), 0, func(event *timelineEvent) error {
+		chat = event.Data.(*SyncChat)
+		return nil
+	})
+	if chat == nil || chat.ChatId != 211 {
+		t.Errorf("got %#v, want chat_id 211", chat)
+	}
+}
@@ -0,0 +1,333 @@
+package ndscloud
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 消息to字段语法：
+//
+//	to    = union [ "@" ids ]          兼容旧格式，如 T@101,102
+//	union = inter { "|" inter }        并集，如 T|S
+//	inter = excl { "&" excl }          交集，如 S:c1&101,102,103
+//	excl  = atom { "!" atom }          排除，如 S!101,102
+//	atom  = group [ ":" classroom ]    分组，可限定教室，如 S:c1
+//	      | ids
+//	group = "A" | "T" | "S" | "D" | "N"
+//	ids   = id { "," id }
+//
+// 优先级由高到低：":"、"!"、"&"、"|"、"@"。
+// A全体，T老师，S学生，D设备，N本地中控；教室取自UnitInfo.Classroom。
+
+// to字段语法错误，返回给客户端
+type ToSyntaxError struct {
+	To  string
+	Pos int
+	Msg string
+}
+
+func (e *ToSyntaxError) Error() string {
+	return fmt.Sprintf("Bad field 'to' at %d: %s", e.Pos, e.Msg)
+}
+
+// to字段表达式，根据单元缓存计算接收者集合
+type ToExpr interface {
+	Eval(uc *UnitCache) map[string]struct{}
+	// 表达式中引用的教室
+	Classrooms() []string
+}
+
+type (
+	toGroup struct {
+		group     string
+		classroom string
+	}
+	toIds   []string
+	toUnion []ToExpr
+	toInter []ToExpr
+	toExcl  []ToExpr
+)
+
+func (g *toGroup) Eval(uc *UnitCache) map[string]struct{} {
+	var set map[string]struct{}
+	switch g.group {
+	case "A":
+		set = uc.All
+	case "T":
+		set = uc.Tea
+	case "S":
+		set = uc.Stu
+	case "D":
+		set = uc.Dev
+	case "N":
+		set = uc.Nds
+	}
+	if g.classroom == "" {
+		return copySet(set)
+	}
+	return interSet(set, uc.Cls[g.classroom])
+}
+
+func (g *toGroup) Classrooms() []string {
+	if g.classroom == "" {
+		return nil
+	}
+	return []string{g.classroom}
+}
+
+func (ids toIds) Eval(uc *UnitCache) map[string]struct{} {
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+func (ids toIds) Classrooms() []string {
+	return nil
+}
+
+func (u toUnion) Eval(uc *UnitCache) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, expr := range u {
+		for id, _ := range expr.Eval(uc) {
+			set[id] = struct{}{}
+		}
+	}
+	return set
+}
+
+func (u toUnion) Classrooms() []string {
+	return classroomsOf(u)
+}
+
+func (in toInter) Eval(uc *UnitCache) map[string]struct{} {
+	set := in[0].Eval(uc)
+	for _, expr := range in[1:] {
+		set = interSet(set, expr.Eval(uc))
+	}
+	return set
+}
+
+func (in toInter) Classrooms() []string {
+	return classroomsOf(in)
+}
+
+func (ex toExcl) Eval(uc *UnitCache) map[string]struct{} {
+	set := ex[0].Eval(uc)
+	for _, expr := range ex[1:] {
+		for id, _ := range expr.Eval(uc) {
+			delete(set, id)
+		}
+	}
+	return set
+}
+
+func (ex toExcl) Classrooms() []string {
+	return classroomsOf(ex)
+}
+
+func classroomsOf(exprs []ToExpr) (list []string) {
+	for _, expr := range exprs {
+		list = append(list, expr.Classrooms()...)
+	}
+	return
+}
+
+// 表达式是否指向单元所有终端(包括之后加入的)，如"A"、"A|T"、"A@s1"
+func toAll(expr ToExpr) bool {
+	switch e := expr.(type) {
+	case *toGroup:
+		return e.group == "A" && e.classroom == ""
+	case toUnion:
+		for _, sub := range e {
+			if toAll(sub) {
+				return true
+			}
+		}
+	case toInter:
+		for _, sub := range e {
+			if !toAll(sub) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func copySet(set map[string]struct{}) map[string]struct{} {
+	dst := make(map[string]struct{}, len(set))
+	for id, _ := range set {
+		dst[id] = struct{}{}
+	}
+	return dst
+}
+
+func interSet(a, b map[string]struct{}) map[string]struct{} {
+	dst := make(map[string]struct{})
+	for id, _ := range a {
+		if _, ok := b[id]; ok {
+			dst[id] = struct{}{}
+		}
+	}
+	return dst
+}
+
+// 解析to字段
+func ParseTo(to string) (ToExpr, error) {
+	p := &toParser{to: to}
+	if to == "" {
+		return nil, p.errorf("empty")
+	}
+	expr, err := p.union()
+	if err != nil {
+		return nil, err
+	}
+	// 兼容旧格式：分组@个人
+	if p.peek() == '@' {
+		p.pos++
+		union := toUnion{expr}
+		if !p.eof() {
+			ids, err := p.ids()
+			if err != nil {
+				return nil, err
+			}
+			union = append(union, ids)
+		}
+		expr = union
+	}
+	if !p.eof() {
+		return nil, p.errorf("unexpected '%c'", p.peek())
+	}
+	return expr, nil
+}
+
+// 解析to字段，并校验引用的教室是否属于该单元
+func ParseToInUnit(to string, unitInfo *UnitInfo) (ToExpr, error) {
+	expr, err := ParseTo(to)
+	if err != nil {
+		return nil, err
+	}
+	for _, classroom := range expr.Classrooms() {
+		found := false
+		for _, item := range unitInfo.Classroom {
+			if item.Id == classroom {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &ToSyntaxError{To: to, Pos: strings.Index(to, ":"+classroom) + 1, Msg: "unknown classroom " + classroom}
+		}
+	}
+	return expr, nil
+}
+
+type toParser struct {
+	to  string
+	pos int
+}
+
+func (p *toParser) errorf(format string, args ...interface{}) error {
+	return &ToSyntaxError{To: p.to, Pos: p.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *toParser) eof() bool {
+	return p.pos >= len(p.to)
+}
+
+func (p *toParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.to[p.pos]
+}
+
+func (p *toParser) union() (ToExpr, error) {
+	return p.binary('|', p.inter, func(list []ToExpr) ToExpr { return toUnion(list) })
+}
+
+func (p *toParser) inter() (ToExpr, error) {
+	return p.binary('&', p.excl, func(list []ToExpr) ToExpr { return toInter(list) })
+}
+
+func (p *toParser) excl() (ToExpr, error) {
+	return p.binary('!', p.atom, func(list []ToExpr) ToExpr { return toExcl(list) })
+}
+
+// 解析由op连接的一个或多个操作数
+func (p *toParser) binary(op byte, operand func() (ToExpr, error), combine func([]ToExpr) ToExpr) (ToExpr, error) {
+	expr, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	list := []ToExpr{expr}
+	for p.peek() == op {
+		p.pos++
+		expr, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, expr)
+	}
+	if len(list) == 1 {
+		return list[0], nil
+	}
+	return combine(list), nil
+}
+
+func (p *toParser) atom() (ToExpr, error) {
+	start := p.pos
+	name := p.name()
+	switch name {
+	case "":
+		if p.eof() {
+			return nil, p.errorf("unexpected end")
+		}
+		return nil, p.errorf("unexpected '%c'", p.peek())
+	case "A", "T", "S", "D", "N":
+		group := &toGroup{group: name}
+		if p.peek() == ':' {
+			p.pos++
+			group.classroom = p.name()
+			if group.classroom == "" {
+				return nil, p.errorf("missing classroom")
+			}
+		}
+		return group, nil
+	}
+	p.pos = start
+	return p.ids()
+}
+
+func (p *toParser) ids() (ToExpr, error) {
+	ids := make(toIds, 0, 1)
+	for {
+		id := p.name()
+		if id == "" {
+			return nil, p.errorf("missing id")
+		}
+		if len(id) == 1 && strings.Contains("ATSDN", id) {
+			return nil, &ToSyntaxError{To: p.to, Pos: p.pos - 1, Msg: "group " + id + " in id list"}
+		}
+		ids = append(ids, id)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.peek() == ':' {
+		return nil, p.errorf("classroom must follow a group")
+	}
+	return ids, nil
+}
+
+// 读取一个分组名、教室id或个人id
+func (p *toParser) name() string {
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune("|&!@:, ", rune(p.peek())) {
+		p.pos++
+	}
+	return p.to[start:p.pos]
+}
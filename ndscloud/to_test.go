@@ -0,0 +1,133 @@
+package ndscloud
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// 单元内终端：老师t1(教室c1)、t2(c2)，学生s1、s2(c1)、s3(c2)，设备d1(c1)，本地中控n1(c2)
+func testUnitCache() *UnitCache {
+	uc := NewUnitCache()
+	add := func(set map[string]struct{}, ids ...string) {
+		for _, id := range ids {
+			set[id] = struct{}{}
+		}
+	}
+	add(uc.All, "t1", "t2", "s1", "s2", "s3", "d1", "n1")
+	add(uc.Tea, "t1", "t2")
+	add(uc.Stu, "s1", "s2", "s3")
+	add(uc.Dev, "d1", "n1")
+	add(uc.Nds, "n1")
+	uc.Cls["c1"] = make(map[string]struct{})
+	uc.Cls["c2"] = make(map[string]struct{})
+	add(uc.Cls["c1"], "t1", "s1", "s2", "d1")
+	add(uc.Cls["c2"], "t2", "s3", "n1")
+	return uc
+}
+
+// 校验err为to的语法错误且包含want
+func checkToSyntaxError(t *testing.T, to string, err error, want string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("got no error, want %q", want)
+	}
+	serr, ok := err.(*ToSyntaxError)
+	if !ok {
+		t.Fatalf("got %T %v, want *ToSyntaxError", err, err)
+	}
+	if serr.To != to {
+		t.Errorf("error.To = %q, want %q", serr.To, to)
+	}
+	if !strings.Contains(serr.Error(), want) {
+		t.Errorf("got error %q, want %q", serr.Error(), want)
+	}
+}
+
+func TestParseTo(t *testing.T) {
+	cases := []struct {
+		to   string
+		want string // 排序后的接收者，以逗号分隔
+		err  string // 期望的语法错误片段
+	}{
+		// 兼容旧格式
+		{to: "A", want: "d1,n1,s1,s2,s3,t1,t2"},
+		{to: "T", want: "t1,t2"},
+		{to: "S", want: "s1,s2,s3"},
+		{to: "D", want: "d1,n1"},
+		{to: "T|S", want: "s1,s2,s3,t1,t2"},
+		{to: "A|T", want: "d1,n1,s1,s2,s3,t1,t2"},
+		{to: "T@s1,s2", want: "s1,s2,t1,t2"},
+		{to: "T|D@s1", want: "d1,n1,s1,t1,t2"},
+		{to: "T@", want: "t1,t2"},
+		{to: "s1", want: "s1"},
+		{to: "s1,s3,x9", want: "s1,s3,x9"},
+
+		// 本地中控
+		{to: "N", want: "n1"},
+		{to: "D!N", want: "d1"},
+
+		// 教室
+		{to: "S:c1", want: "s1,s2"},
+		{to: "A:c2", want: "n1,s3,t2"},
+		{to: "T:c1|S:c2", want: "s3,t1"},
+
+		// 排除
+		{to: "S!s1,s2", want: "s3"},
+		{to: "A!T!D", want: "s1,s2,s3"},
+		{to: "A:c1!T", want: "d1,s1,s2"},
+		{to: "S!s1|T", want: "s2,s3,t1,t2"},
+
+		// 交集
+		{to: "S&s1,s3,x9", want: "s1,s3"},
+		{to: "A:c1&S", want: "s1,s2"},
+		{to: "S&A:c2|T&A:c1", want: "s3,t1"},
+		{to: "A&S!s2@t2", want: "s1,s3,t2"},
+
+		// 语法错误
+		{to: "", err: "empty"},
+		{to: "S!", err: "at 2: unexpected end"},
+		{to: "|S", err: "at 0: unexpected '|'"},
+		{to: "S||T", err: "at 2: unexpected '|'"},
+		{to: "S:", err: "at 2: missing classroom"},
+		{to: "s1:c1", err: "classroom must follow a group"},
+		{to: "s1,", err: "missing id"},
+		{to: "s1,T", err: "group T in id list"},
+		{to: "T@S", err: "group S in id list"},
+		{to: "T@s1|S", err: "at 4: unexpected '|'"},
+		{to: "S T", err: "at 1: unexpected ' '"},
+	}
+
+	uc := testUnitCache()
+	for _, c := range cases {
+		c := c
+		t.Run(c.to, func(t *testing.T) {
+			expr, err := ParseTo(c.to)
+			if c.err != "" {
+				checkToSyntaxError(t, c.to, err, c.err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v, want %s", err, c.want)
+			}
+			ids := make([]string, 0)
+			for id := range expr.Eval(uc) {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			if got := strings.Join(ids, ","); got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+// 引用单元外的教室
+func TestParseToInUnit(t *testing.T) {
+	unitInfo := &UnitInfo{Classroom: []ClassroomInfo{{Id: "c1"}, {Id: "c2"}}}
+	if _, err := ParseToInUnit("S:c1|T:c2", unitInfo); err != nil {
+		t.Errorf("S:c1|T:c2: got error %v", err)
+	}
+	_, err := ParseToInUnit("S:c3", unitInfo)
+	checkToSyntaxError(t, "S:c3", err, "at 2: unknown classroom c3")
+}